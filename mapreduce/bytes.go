@@ -0,0 +1,93 @@
+package mapreduce
+
+// BytePair is a Pair with binary key and value
+type BytePair struct {
+	Key   []byte
+	Value []byte
+}
+
+// ByteInterface is ContextInterface for binary data. The pairs it emits are
+// stored as blobs all the way to the final output, so keys and values arrive
+// exactly as they were written, and a reduce task sees its keys in byte-wise
+// order. The optional interfaces (Combiner, Partitioned,
+// KeyOrder, Grouper) still see keys as strings holding the same bytes.
+type ByteInterface interface {
+	MapBytes(ctx *TaskContext, key, value []byte, output chan<- BytePair) error
+	ReduceBytes(ctx *TaskContext, key []byte, values <-chan []byte, output chan<- BytePair) error
+}
+
+// StartBytes runs this process as a master or a worker for a binary client
+func StartBytes(client ByteInterface) error {
+	return StartContext(byteClient{client})
+}
+
+// byteClient runs a ByteInterface client as a ContextInterface one
+type byteClient struct {
+	ByteInterface
+}
+
+func (c byteClient) MapContext(ctx *TaskContext, key, value string, output chan<- Pair) error {
+	defer close(output)
+	pairs := make(chan BytePair, 100)
+	copied := make(chan struct{})
+	go func() {
+		copyBytePairs(pairs, output)
+		close(copied)
+	}()
+
+	defer func() {
+		closeQuietly(pairs)
+		<-copied
+	}()
+	return c.MapBytes(ctx, []byte(key), []byte(value), pairs)
+}
+
+func (c byteClient) ReduceContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	byteValues := make(chan []byte)
+	go func() {
+		defer close(byteValues)
+		for value := range values {
+			byteValues <- []byte(value)
+		}
+	}()
+
+	pairs := make(chan BytePair, 100)
+	copied := make(chan struct{})
+	go func() {
+		copyBytePairs(pairs, output)
+		close(copied)
+	}()
+
+	defer func() {
+		closeQuietly(pairs)
+		<-copied
+		for range byteValues {
+		}
+	}()
+	return c.ReduceBytes(ctx, []byte(key), byteValues, pairs)
+}
+
+// whether the pairs client emits are stored as blobs. Only a ByteInterface
+// client's are; the others' are text, so their output can be queried with
+// plain string literals. All of a job's pairs come from one client, so the
+// two never mix in a table (sqlite sorts every text value before any blob).
+func storesBlobs(client ContextInterface) bool {
+	_, ok := client.(byteClient)
+	return ok
+}
+
+// the arguments inserting pair into a pairs table, stored as blobs or text
+func pairArgs(pair Pair, blobs bool) (interface{}, interface{}) {
+	if blobs {
+		return []byte(pair.Key), []byte(pair.Value)
+	}
+	return pair.Key, pair.Value
+}
+
+// copies the pairs from pairs into output until pairs is closed
+func copyBytePairs(pairs <-chan BytePair, output chan<- Pair) {
+	for pair := range pairs {
+		output <- Pair{Key: string(pair.Key), Value: string(pair.Value)}
+	}
+}
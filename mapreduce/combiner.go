@@ -0,0 +1,119 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime/debug"
+	"sort"
+)
+
+// Combiner can be implemented alongside Interface to pre-aggregate the
+// output of a map task before it is written. Combine gets the values the map
+// task emitted for one key and emits pairs to write in their place, so it is
+// usually the same as Reduce. It may run several times for the same key (once
+// per spill) and its output may be combined again, so it must not change the
+// final result when applied to partial groups. A map-only job (R=0) doesn't
+// combine, its output is exactly what Map emitted.
+type Combiner interface {
+	Combine(key string, values <-chan string, output chan<- Pair) error
+}
+
+// a map task holds at most this many values in memory before combining them
+// and writing the result out
+const combineSpillValues = 100000
+
+// combineBuffer groups the output of a map task by partition and key until
+// it is combined and spilled to the map output databases
+type combineBuffer struct {
+	combiner Combiner
+	parts    []map[string][]string // one per reduce task
+	values   int                   // values held across all partitions
+	blobs    bool                  // see storesBlobs
+}
+
+func newCombineBuffer(combiner Combiner, reduceTasks int, blobs bool) *combineBuffer {
+	b := &combineBuffer{combiner: combiner, parts: make([]map[string][]string, reduceTasks), blobs: blobs}
+	for r := range b.parts {
+		b.parts[r] = make(map[string][]string)
+	}
+	return b
+}
+
+func (b *combineBuffer) add(r int, pair Pair) {
+	b.parts[r][pair.Key] = append(b.parts[r][pair.Key], pair.Value)
+	b.values += 1
+}
+
+func (b *combineBuffer) full() bool {
+	return b.values >= combineSpillValues
+}
+
+// runs Combine on every key held, writing what it emits to the output of
+// the key's partition, and empties the buffer
+func (b *combineBuffer) spill(outputStmts []*sql.Stmt) error {
+	for r, part := range b.parts {
+		keys := make([]string, 0, len(part))
+		for key := range part {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			values := make(chan string, len(part[key]))
+			for _, value := range part[key] {
+				values <- value
+			}
+			close(values)
+
+			output := make(chan Pair, 100)
+			combineErr := make(chan error, 1)
+			go func() {
+				combineErr <- callCombine(b.combiner, key, values, output)
+				closeQuietly(output)
+			}()
+
+			// keep draining output after a failed insert so Combine can finish
+			var insertErr error
+			var pairs int64
+			for pair := range output {
+				if insertErr != nil {
+					continue
+				}
+				if _, err := outputStmts[r].Exec(pairArgs(pair, b.blobs)); err != nil {
+					insertErr = fmt.Errorf("error writing combined pair: %v", err)
+				}
+				pairs += 1
+			}
+			IncrCounter(CombineOutputRecords, pairs)
+			if err := <-combineErr; err != nil {
+				return err
+			}
+			if insertErr != nil {
+				return insertErr
+			}
+		}
+		b.parts[r] = make(map[string][]string)
+	}
+	b.values = 0
+	return nil
+}
+
+// runs client.Combine like callReduce does client.Reduce. The key is an
+// intermediate key rather than an input record, so a failure here is not
+// blamed on a record that could be skipped.
+func callCombine(combiner Combiner, key string, values <-chan string, output chan<- Pair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &UserError{Func: "Combine", Key: key, Err: fmt.Errorf("%v", r), Stack: string(debug.Stack())}
+		}
+		if err != nil {
+			closeQuietly(output)
+		}
+		for range values {
+		}
+	}()
+	if err := combiner.Combine(key, values, output); err != nil {
+		return &UserError{Func: "Combine", Key: key, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package mapreduce
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressions input files can have, known by their extension
+const (
+	gzipCompression = "gzip" // [ex. access.log.gz], read as a whole
+	zstdCompression = "zstd" // [ex. access.log.zst], cut between frames
+)
+
+func compressionOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return gzipCompression
+	case ".zst", ".zstd":
+		return zstdCompression
+	}
+	return ""
+}
+
+// zstdFrame is where a frame of a zstd file starts, in the file and in the
+// decompressed content
+type zstdFrame struct {
+	offset int64
+	start  int64
+}
+
+// fileLayout says where a file can be cut into splits: anywhere in a plain
+// file, only around a whole gzip file (a gzip stream can't be read from the
+// middle), and between the frames of a zstd file
+type fileLayout struct {
+	path        string
+	size        int64
+	compression string
+	frames      []zstdFrame // zstd only, ending with the end of the file
+}
+
+func layoutOf(path string, size int64) (*fileLayout, error) {
+	layout := &fileLayout{path: path, size: size, compression: compressionOf(path)}
+	if layout.compression == zstdCompression {
+		frames, err := zstdFrames(path, size)
+		if err != nil {
+			return nil, fmt.Errorf("reading zstd frames of %s: %v", path, err)
+		}
+		layout.frames = frames
+	}
+	return layout, nil
+}
+
+// moves offset to the nearest place the file can be cut
+func (l *fileLayout) snap(offset int64) int64 {
+	switch l.compression {
+	case gzipCompression:
+		if 2*offset < l.size {
+			return 0
+		}
+		return l.size
+	case zstdCompression:
+		i := sort.Search(len(l.frames), func(i int) bool { return l.frames[i].offset >= offset })
+		if i == len(l.frames) {
+			return l.size
+		}
+		if i > 0 && offset-l.frames[i-1].offset < l.frames[i].offset-offset {
+			i--
+		}
+		return l.frames[i].offset
+	}
+	return offset
+}
+
+// the split of the file between two places it can be cut, in decompressed
+// bytes for a compressed file
+func (l *fileLayout) split(lo, hi int64) fileSplit {
+	switch l.compression {
+	case gzipCompression:
+		return fileSplit{path: l.path, start: 0, end: math.MaxInt64}
+	case zstdCompression:
+		return fileSplit{path: l.path, start: l.startAt(lo), end: l.startAt(hi), frames: l.frames}
+	}
+	return fileSplit{path: l.path, start: lo, end: hi}
+}
+
+// where the frame at offset starts in the decompressed content
+func (l *fileLayout) startAt(offset int64) int64 {
+	i := sort.Search(len(l.frames), func(i int) bool { return l.frames[i].offset >= offset })
+	return l.frames[i].start
+}
+
+// zstdFrames lists the frames of the zstd file at path; skippable frames
+// are left out. Frames that don't give their content size in the header are
+// decompressed to measure them.
+func zstdFrames(path string, size int64) ([]zstdFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var frames []zstdFrame
+	var offset, start int64
+	buf := make([]byte, zstd.HeaderMaxSize)
+	for offset < size {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var header zstd.Header
+		if err := header.Decode(buf[:n]); err != nil {
+			return nil, fmt.Errorf("frame at %d: %v", offset, err)
+		}
+		if header.Skippable {
+			offset += int64(header.HeaderSize) + int64(header.SkippableSize)
+			continue
+		}
+
+		length, err := zstdFrameLength(f, offset, &header)
+		if err != nil {
+			return nil, fmt.Errorf("frame at %d: %v", offset, err)
+		}
+		content := int64(header.FrameContentSize)
+		if !header.HasFCS {
+			if content, err = zstdContentSize(f, offset, length); err != nil {
+				return nil, fmt.Errorf("frame at %d: %v", offset, err)
+			}
+		}
+		frames = append(frames, zstdFrame{offset: offset, start: start})
+		offset += length
+		start += content
+	}
+	return append(frames, zstdFrame{offset: size, start: start}), nil
+}
+
+// the length of the frame at offset, found by walking its block headers
+func zstdFrameLength(f *os.File, offset int64, header *zstd.Header) (int64, error) {
+	pos := offset + int64(header.HeaderSize)
+	var block [3]byte
+	for {
+		if _, err := f.ReadAt(block[:], pos); err != nil {
+			return 0, fmt.Errorf("block header at %d: %v", pos, err)
+		}
+		bits := int64(block[0]) | int64(block[1])<<8 | int64(block[2])<<16
+		last, blockType, blockSize := bits&1 == 1, (bits>>1)&3, bits>>3
+		switch blockType {
+		case 1: // RLE: one byte repeated blockSize times
+			blockSize = 1
+		case 3:
+			return 0, fmt.Errorf("reserved block type at %d", pos)
+		}
+		pos += 3 + blockSize
+		if last {
+			break
+		}
+	}
+	if header.HasCheckSum {
+		pos += 4
+	}
+	return pos - offset, nil
+}
+
+// decompresses the frame at offset to count its bytes
+func zstdContentSize(f *os.File, offset, length int64) (int64, error) {
+	dec, err := zstd.NewReader(io.NewSectionReader(f, offset, length), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+	return io.Copy(io.Discard, dec)
+}
+
+// openSplit opens the file of split with its reader at offset, counted in
+// decompressed bytes for a compressed file, and returns a function that
+// closes it
+func openSplit(split fileSplit, offset int64) (io.Reader, func(), error) {
+	f, err := os.Open(split.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var r io.Reader = f
+	closeFile := func() { f.Close() }
+	switch compressionOf(split.path) {
+	case gzipCompression:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = gz
+	case zstdCompression:
+		// start decoding at the frame offset falls in, if the frames are known
+		var section io.Reader = f
+		frameStart := int64(0)
+		if i := sort.Search(len(split.frames), func(i int) bool { return split.frames[i].start > offset }) - 1; i >= 0 {
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			section = io.NewSectionReader(f, split.frames[i].offset, info.Size()-split.frames[i].offset)
+			frameStart = split.frames[i].start
+		}
+		dec, err := zstd.NewReader(section, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = dec
+		closeFile = func() {
+			dec.Close()
+			f.Close()
+		}
+		offset -= frameStart
+	default:
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return r, closeFile, nil
+	}
+
+	// a compressed stream is read up to offset
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		closeFile()
+		return nil, nil, err
+	}
+	return r, closeFile, nil
+}
@@ -0,0 +1,131 @@
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzips content as two members, the way concatenated .gz files look
+func gzipped(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, part := range [][]byte{content[:len(content)/3], content[len(content)/3:]} {
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// compresses content as a zstd frame every frameSize bytes, cut wherever
+// that falls in a line, and returns the frames it should have. It starts
+// with a skippable frame, and every other frame is written by a streaming
+// encoder, flushed before it has all its content so the frame header has
+// no content size.
+func zstdFramed(t *testing.T, content []byte, frameSize int) ([]byte, []zstdFrame) {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	buf := bytes.NewBuffer([]byte{0x50, 0x2a, 0x4d, 0x18, 4, 0, 0, 0, 1, 2, 3, 4})
+	var frames []zstdFrame
+	for start, i := 0, 0; start < len(content); i++ {
+		end := min(start+frameSize, len(content))
+		frames = append(frames, zstdFrame{offset: int64(buf.Len()), start: int64(start)})
+		if i%2 == 0 {
+			buf.Write(enc.EncodeAll(content[start:end], nil))
+		} else {
+			w, err := zstd.NewWriter(buf, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(content[start : (start+end)/2])
+			w.Flush()
+			w.Write(content[(start+end)/2 : end])
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start = end
+	}
+	return buf.Bytes(), append(frames, zstdFrame{offset: int64(buf.Len()), start: int64(len(content))})
+}
+
+func TestZstdFrames(t *testing.T) {
+	// a run of one byte is written as RLE blocks
+	content := slices.Concat(testText(500), bytes.Repeat([]byte("\n"), 30000), testText(100))
+	data, want := zstdFramed(t, content, 10000)
+	path := writeFile(t, filepath.Join(t.TempDir(), "a.log.zst"), data)
+
+	frames, err := zstdFrames(path, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(frames, want) {
+		t.Errorf("frames are %v, want %v", frames, want)
+	}
+}
+
+func TestOpenSplitAtOffset(t *testing.T) {
+	dir := t.TempDir()
+	content := testText(300)
+	zst, frames := zstdFramed(t, content, 7000)
+	files := []fileSplit{
+		{path: writeFile(t, filepath.Join(dir, "a.log"), content)},
+		{path: writeFile(t, filepath.Join(dir, "a.log.gz"), gzipped(t, content))},
+		{path: writeFile(t, filepath.Join(dir, "a.log.zst"), zst), frames: frames},
+		{path: filepath.Join(dir, "a.log.zst")}, // frames unknown, decoded from the start
+	}
+
+	for _, split := range files {
+		for _, offset := range []int64{0, 1, 6999, 7000, 7001, int64(len(content)) / 2, int64(len(content))} {
+			r, closeSplit, err := openSplit(split, offset)
+			if err != nil {
+				t.Fatalf("%s at %d: %v", split.path, offset, err)
+			}
+			got, err := io.ReadAll(r)
+			closeSplit()
+			if err != nil {
+				t.Fatalf("%s at %d: %v", split.path, offset, err)
+			}
+			if !bytes.Equal(got, content[offset:]) {
+				t.Errorf("%s at %d (frames known: %v): read %d bytes, want the last %d of the content", split.path, offset, split.frames != nil, len(got), len(content)-int(offset))
+			}
+		}
+	}
+}
+
+func TestReadCompressedLinesOnce(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := testText(300), testText(700), testText(50)
+	zst, _ := zstdFramed(t, b, 9000)
+	files := []string{
+		writeFile(t, filepath.Join(dir, "a.log.gz"), gzipped(t, a)),
+		writeFile(t, filepath.Join(dir, "b.log.zst"), zst),
+		writeFile(t, filepath.Join(dir, "c.log"), c),
+	}
+	lines := [][]string{linesOf(files[0], a), linesOf(files[1], b), linesOf(files[2], c)}
+
+	for i, file := range files {
+		for _, m := range splitCounts {
+			checkLines(t, m, readSplits(t, []string{file}, m), lines[i])
+		}
+	}
+	want := slices.Concat(lines...)
+	for _, m := range splitCounts {
+		checkLines(t, m, readSplits(t, files, m), want)
+	}
+}
@@ -0,0 +1,292 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds everything needed to start a master or a worker. It can be
+// filled from a JSON job-spec file, from command-line flags, or from the
+// interactive prompt in getInput.
+type Config struct {
+	IsMaster   bool     `json:"-"`
+	Name       string   `json:"name"`        // job name
+	Input      []string `json:"input"`       // paths of the input databases, or files, directories and globs for text
+	Format     string   `json:"format"`      // how to read Input: "sqlite" (default), "text", "jsonl" or "csv"
+	Output     string   `json:"output"`      // path of the final output database
+	Overwrite  bool     `json:"overwrite"`   // replace Output if it exists instead of refusing to run
+	M          int      `json:"m"`           // number of map tasks
+	R          int      `json:"r"`           // number of reduce tasks
+	MasterPort string   `json:"master_port"` // port the master listens on
+	WorkerPort string   `json:"worker_port"` // port a worker listens on
+	Master     string   `json:"master"`      // address of the master [ex. 192.168.0.241:3410]
+	TempDir    string   `json:"temp_dir"`    // temporary directory inside data/ [ex. tmp3410/]
+	Lease      Duration `json:"lease"`       // how long a task attempt may go without a heartbeat before it is re-executed
+	Heartbeat  Duration `json:"heartbeat"`   // how often a worker tells the master it is alive
+	// how long the master waits for a heartbeat before presuming a worker dead
+	HeartbeatTimeout Duration `json:"heartbeat_timeout"`
+	// back up tasks running this many times longer than the median (0 = never)
+	Straggler float64 `json:"straggler"`
+	// a task failing this many times fails the whole job
+	MaxFailures int `json:"max_failures"`
+	// skip a record once it has made its task fail this many times (0 = never);
+	// those failures still count toward MaxFailures, so it has to be lower
+	SkipAfter int `json:"skip_after"`
+	// range partition on keys sampled from the input so the output is sorted
+	// as a whole, not just within each reduce task
+	Sort bool `json:"sort"`
+	// job parameters handed to ContextInterface clients [ex. "pattern": "^the"]
+	Params map[string]string `json:"params"`
+	// sqlite file the master keeps its state in (default data/<name>.journal.db)
+	Journal string `json:"journal"`
+	// how long a worker keeps retrying while the master is unreachable
+	Patience Duration `json:"master_patience"`
+	// which fields of jsonl and csv records become the key and the value
+	Fields Fields `json:"fields"`
+	// table of sqlite inputs with key and value columns (default pairs)
+	Table string `json:"table"`
+	// read-only SELECT on sqlite inputs whose two columns are the key and the
+	// value, read instead of Table [ex. "SELECT id, name || ',' || email FROM users"]
+	Query string `json:"query"`
+	// several inputs to read at once, instead of Input and the settings above
+	// (which make up a single input named "input")
+	Inputs []InputSpec `json:"inputs"`
+}
+
+// Duration is a time.Duration written as "90s" or "5m" in job specs and flags
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(value string) error {
+	var err error
+	d.Duration, err = time.ParseDuration(value)
+	return err
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations are strings like \"90s\": %v", err)
+	}
+	return d.Set(value)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// listFlag is a comma-separated list of values; the flag may also be repeated
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	// the first use on the command line replaces the default
+	if !f.set {
+		*f.list = nil
+		f.set = true
+	}
+	for _, elt := range strings.Split(value, ",") {
+		if elt = strings.TrimSpace(elt); elt != "" {
+			*f.list = append(*f.list, elt)
+		}
+	}
+	return nil
+}
+
+/*
+EXAMPLES OF COMMAND LINES:
+	- mapreduce master -port 3410 -m 20 -r 5
+	- mapreduce worker -port 3411 -master 192.168.0.241:3410
+	- mapreduce master -spec job.json
+	- mapreduce worker -spec job.json -port 3412
+*/
+
+const usage = "usage: %s [master|worker] [flags]\n(run with no arguments for interactive prompts)\n"
+
+// parseConfig reads the subcommand, flags and job spec from args
+// (os.Args without the program name). With no arguments it falls back to
+// the interactive prompts.
+func parseConfig(args []string) (*Config, error) {
+	cfg := &Config{
+		Name:   "mapreduce",
+		Input:  []string{"data/austen.db"},
+		Format: SQLiteInput,
+		Table:  "pairs",
+		Output: "data/finalOutput.db",
+		Lease:  Duration{time.Minute},
+
+		Heartbeat:        Duration{2 * time.Second},
+		HeartbeatTimeout: Duration{10 * time.Second},
+		Straggler:        2,
+		MaxFailures:      4,
+		Patience:         Duration{time.Minute},
+		Params:           make(map[string]string),
+	}
+
+	if len(args) == 0 {
+		getInput(cfg)
+		return cfg, cfg.check()
+	}
+
+	switch args[0] {
+	case "master":
+		cfg.IsMaster = true
+	case "worker":
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		return nil, fmt.Errorf("unknown command %q", args[0])
+	}
+
+	// parse once to find the spec, load it, then parse again so
+	// flags given on the command line override the spec
+	var specPath string
+	fs := cfg.flagSet(args[0], &specPath)
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	if specPath != "" {
+		if err := loadSpec(specPath, cfg); err != nil {
+			return nil, err
+		}
+		fs = cfg.flagSet(args[0], &specPath)
+		if err := fs.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	return cfg, cfg.check()
+}
+
+// flagSet binds the flags of a subcommand to cfg, using the current values
+// as defaults
+func (cfg *Config) flagSet(name string, specPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(specPath, "spec", *specPath, "path of a JSON job-spec file")
+	fs.StringVar(&cfg.TempDir, "tmp", cfg.TempDir, "temporary directory inside data/ (default tmp<port>/)")
+	if cfg.IsMaster {
+		fs.StringVar(&cfg.Name, "name", cfg.Name, "job name")
+		fs.Var(&listFlag{list: &cfg.Input}, "input", "comma-separated input paths (files, directories or globs for text)")
+		fs.StringVar(&cfg.Format, "format", cfg.Format, "input format: "+strings.Join(inputFormats, ", "))
+		fs.StringVar(&cfg.Fields.Key, "key-field", cfg.Fields.Key, "jsonl field or csv column to key records on (default file:offset)")
+		fs.Var(&listFlag{list: &cfg.Fields.Value}, "value-fields", "comma-separated fields that make up the value (default the whole record as JSON)")
+		fs.BoolVar(&cfg.Fields.NoHeader, "no-header", cfg.Fields.NoHeader, "csv inputs have no header row (columns are named 0, 1, ...)")
+		fs.StringVar(&cfg.Table, "table", cfg.Table, "table of sqlite inputs with key and value columns")
+		fs.StringVar(&cfg.Query, "query", cfg.Query, "read-only SELECT on sqlite inputs yielding the key and the value, instead of -table")
+		fs.StringVar(&cfg.Output, "output", cfg.Output, "path of the final output database")
+		fs.BoolVar(&cfg.Overwrite, "overwrite", cfg.Overwrite, "replace the output if it already exists")
+		fs.IntVar(&cfg.M, "m", cfg.M, "number of map tasks")
+		fs.IntVar(&cfg.R, "r", cfg.R, "number of reduce tasks (0 for a map-only job)")
+		fs.StringVar(&cfg.MasterPort, "port", cfg.MasterPort, "port to listen on")
+		fs.Var(&cfg.Lease, "lease", "how long a task attempt may go without a heartbeat before it is re-executed")
+		fs.Var(&cfg.HeartbeatTimeout, "heartbeat-timeout", "how long to wait for a heartbeat before presuming a worker dead")
+		fs.IntVar(&cfg.MaxFailures, "max-failures", cfg.MaxFailures, "fail the job once a task has failed this many times")
+		fs.IntVar(&cfg.SkipAfter, "skip-after", cfg.SkipAfter, "skip a record once it has made its task fail this many times (0 = never, otherwise below max-failures)")
+		fs.Float64Var(&cfg.Straggler, "straggler", cfg.Straggler, "back up tasks running this many times longer than the median task (0 = never)")
+		if cfg.Params == nil {
+			cfg.Params = make(map[string]string)
+		}
+		fs.Var(paramsFlag(cfg.Params), "param", "job parameter as name=value (may be repeated)")
+		fs.BoolVar(&cfg.Sort, "sort", cfg.Sort, "sort the whole output by key (range partitions on sampled input keys)")
+		fs.StringVar(&cfg.Journal, "journal", cfg.Journal, "sqlite file to keep the master's state in (default data/<name>.journal.db)")
+	} else {
+		fs.StringVar(&cfg.WorkerPort, "port", cfg.WorkerPort, "port to listen on")
+		fs.StringVar(&cfg.Master, "master", cfg.Master, "address of the master [ex. 192.168.0.241:3410]")
+		fs.Var(&cfg.Heartbeat, "heartbeat", "how often to send a heartbeat to the master")
+		fs.Var(&cfg.Patience, "patience", "how long to keep retrying while the master is unreachable")
+	}
+	return fs
+}
+
+// loadSpec fills cfg from a JSON job-spec file; fields missing from the
+// file keep their current values
+func loadSpec(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading job spec: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("parsing job spec %s: %v", path, err)
+	}
+	return nil
+}
+
+// Port is the port this process listens on
+func (cfg *Config) Port() string {
+	if cfg.IsMaster {
+		return cfg.MasterPort
+	}
+	return cfg.WorkerPort
+}
+
+// check validates the config and fills in the temporary directory
+func (cfg *Config) check() error {
+	if cfg.Port() == "" {
+		return errors.New("no port given")
+	}
+	if cfg.IsMaster {
+		if len(cfg.Inputs) == 0 {
+			if len(cfg.Input) == 0 {
+				return errors.New("no input given")
+			}
+			cfg.Inputs = []InputSpec{{Name: "input", Paths: cfg.Input, Format: cfg.Format, Fields: cfg.Fields, Table: cfg.Table, Query: cfg.Query}}
+		}
+		names := make(map[string]bool)
+		for i := range cfg.Inputs {
+			if err := cfg.Inputs[i].check(); err != nil {
+				return err
+			}
+			if names[cfg.Inputs[i].Name] {
+				return fmt.Errorf("two inputs are named %s", cfg.Inputs[i].Name)
+			}
+			names[cfg.Inputs[i].Name] = true
+		}
+		if cfg.Lease.Duration <= 0 || cfg.HeartbeatTimeout.Duration <= 0 {
+			return errors.New("lease and heartbeat timeout must be positive")
+		}
+		if cfg.MaxFailures < 1 {
+			return errors.New("max-failures must be at least 1")
+		}
+		if cfg.SkipAfter > 0 && cfg.SkipAfter >= cfg.MaxFailures {
+			return fmt.Errorf("skip-after must be below max-failures (%d) for a record to ever be skipped", cfg.MaxFailures)
+		}
+		if cfg.M < 1 || cfg.R < 0 {
+			return fmt.Errorf("need at least one map task and no negative number of reduce tasks, got M=%d R=%d", cfg.M, cfg.R)
+		}
+		if cfg.M < len(cfg.Inputs) {
+			return fmt.Errorf("need at least one map task for each of the %d inputs, got M=%d", len(cfg.Inputs), cfg.M)
+		}
+		if cfg.Sort && cfg.R == 0 {
+			return errors.New("sorting needs reduce tasks, a map-only job (R=0) can't sort")
+		}
+	} else if cfg.Master == "" {
+		return errors.New("no master address given")
+	} else if cfg.Heartbeat.Duration <= 0 {
+		return errors.New("heartbeat interval must be positive")
+	} else if cfg.Patience.Duration < 0 {
+		return errors.New("patience must not be negative")
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = makeTempDir(cfg.Port())
+	} else if !strings.HasSuffix(cfg.TempDir, "/") {
+		cfg.TempDir += "/"
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package mapreduce
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ContextInterface is the second version of Interface. Map and Reduce get a
+// TaskContext with the job's parameters and a context that is cancelled
+// when the master gives up on the attempt. As in Interface, they close their
+// output when done. Clients written against Interface keep working through
+// Start.
+type ContextInterface interface {
+	MapContext(ctx *TaskContext, key, value string, output chan<- Pair) error
+	ReduceContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) error
+}
+
+// TaskContext describes the task attempt a Map or Reduce call belongs to
+type TaskContext struct {
+	// cancelled once the master has given up on this attempt (its lease ran
+	// out, another attempt finished first, or the job is over); long-running
+	// calls should check Done or Err and return
+	context.Context
+	Params  map[string]string // job parameters from the spec or -param flags
+	TaskID  string            // [ex. "map 3", "reduce 0"]
+	Attempt int
+	Log     *log.Logger // logs prefixed with the task and attempt
+	// name of the input a map task's records come from (see InputSpec);
+	// empty in reduce tasks
+	Input string
+}
+
+// Param returns the job parameter name, or def if the job doesn't set it
+func (tc *TaskContext) Param(name, def string) string {
+	if value, ok := tc.Params[name]; ok {
+		return value
+	}
+	return def
+}
+
+// IncrCounter adds delta to the named counter of the task, like the
+// package-level IncrCounter
+func (tc *TaskContext) IncrCounter(name string, delta int64) {
+	IncrCounter(name, delta)
+}
+
+func newTaskContext(ctx context.Context, params map[string]string, task string, attempt int) *TaskContext {
+	return &TaskContext{Context: ctx, Params: params, TaskID: task, Attempt: attempt,
+		Log: log.New(os.Stderr, fmt.Sprintf("%s attempt %d: ", task, attempt), log.LstdFlags)}
+}
+
+// legacyClient runs an Interface client as a ContextInterface one
+type legacyClient struct {
+	Interface
+}
+
+func (c legacyClient) MapContext(ctx *TaskContext, key, value string, output chan<- Pair) error {
+	return c.Map(key, value, output)
+}
+
+func (c legacyClient) ReduceContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) error {
+	return c.Reduce(key, values, output)
+}
+
+// the value the client handed to Start, to look up the optional interfaces
+// (Combiner, Partitioned, KeyOrder, Grouper) it implements
+func clientImpl(client ContextInterface) interface{} {
+	switch c := client.(type) {
+	case legacyClient:
+		return c.Interface
+	case byteClient:
+		return c.ByteInterface
+	}
+	return client
+}
+
+// paramsFlag is a key=value job parameter; the flag may be repeated
+type paramsFlag map[string]string
+
+func (f paramsFlag) String() string {
+	var params []string
+	for key, value := range f {
+		params = append(params, key+"="+value)
+	}
+	sort.Strings(params)
+	return strings.Join(params, ",")
+}
+
+func (f paramsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("job parameters look like name=value, got %q", value)
+	}
+	f[key] = val
+	return nil
+}
+
+// Status is what a worker tells the master with each heartbeat
+type Status struct {
+	Address string
+	Busy    bool // running the attempt below
+	IsMap   bool
+	TaskN   int
+	Attempt int
+}
+
+// HeartbeatReply tells a worker whether to give up on its current attempt
+type HeartbeatReply struct {
+	Cancel bool
+}
+
+// runningTask is the attempt a worker is running, shared with the
+// heartbeat goroutine so the master can cancel it
+type runningTask struct {
+	sync.Mutex
+	status Status
+	cancel context.CancelFunc
+}
+
+// records the attempt about to run and returns its context
+func (r *runningTask) start(status Status) context.Context {
+	r.Lock()
+	defer r.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	status.Busy = true
+	r.status, r.cancel = status, cancel
+	return ctx
+}
+
+func (r *runningTask) stop() {
+	r.Lock()
+	defer r.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.status.Busy, r.cancel = false, nil
+}
+
+func (r *runningTask) current() Status {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+// cancels the attempt if it is still the one the master answered about
+func (r *runningTask) cancelIf(status Status) {
+	r.Lock()
+	defer r.Unlock()
+	if r.status == status && r.cancel != nil {
+		fmt.Printf("The master gave up on this attempt, cancelling it.\n")
+		r.cancel()
+	}
+}
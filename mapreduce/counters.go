@@ -0,0 +1,98 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Counters are named totals a task keeps while it runs, in the style of
+// Hadoop counters. Map, Reduce and Combine add to their own with IncrCounter
+// and the framework keeps the ones below. The counters of the attempt that
+// finishes a task go to the master with the completion notice, so retried
+// and backup attempts are counted once, and the master adds them all up for
+// the job.
+type Counters map[string]int64
+
+// counters the framework keeps for every job
+const (
+	MapInputRecords      = "map input records"
+	MapOutputRecords     = "map output records"
+	CombineOutputRecords = "combine output records"
+	ReduceInputGroups    = "reduce input groups"
+	ReduceInputRecords   = "reduce input records"
+	ReduceOutputRecords  = "reduce output records"
+	SkippedRecords       = "skipped records"
+	InputParseErrors     = "input parse errors" // records of the input that couldn't be read
+)
+
+// the counters of the task this worker is running; a worker runs one task
+// at a time, but Map and Reduce run alongside the goroutines collecting
+// their output
+var taskCounters struct {
+	sync.Mutex
+	counters Counters
+}
+
+// IncrCounter adds delta to the named counter of the task being run
+// [ex. mapreduce.IncrCounter("malformed lines", 1)]
+func IncrCounter(name string, delta int64) {
+	taskCounters.Lock()
+	defer taskCounters.Unlock()
+	if taskCounters.counters == nil {
+		taskCounters.counters = make(Counters)
+	}
+	taskCounters.counters[name] += delta
+}
+
+// starts counting from zero for a new task
+func resetCounters() {
+	taskCounters.Lock()
+	defer taskCounters.Unlock()
+	taskCounters.counters = make(Counters)
+}
+
+// hands over the counters of the task that just finished
+func takeCounters() Counters {
+	taskCounters.Lock()
+	defer taskCounters.Unlock()
+	c := taskCounters.counters
+	taskCounters.counters = nil
+	return c
+}
+
+func (c Counters) add(other Counters) {
+	for name, n := range other {
+		c[name] += n
+	}
+}
+
+func (c Counters) names() []string {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c Counters) print() {
+	fmt.Printf("Counters:\n")
+	for _, name := range c.names() {
+		fmt.Printf("\t%s: %d\n", name, c[name])
+	}
+}
+
+// adds a counters table with the totals of the job to db
+func writeCounters(db *sql.DB, c Counters) error {
+	if _, err := db.Exec("create table counters (name text, value integer);"); err != nil {
+		return fmt.Errorf("error creating counters table: %v", err)
+	}
+	for _, name := range c.names() {
+		if _, err := db.Exec("insert into counters (name, value) values (?, ?)", name, c[name]); err != nil {
+			return fmt.Errorf("error writing counters: %v", err)
+		}
+	}
+	return nil
+}
@@ -41,7 +41,10 @@ func createDatabase(path string) (*sql.DB, error) {
 		log.Printf("error opening database: %v\n", err)
 	}
 
-	_, err = db.Exec("create table pairs (key text, value text);")
+	// blob columns have no type affinity: each key and value keeps the type
+	// it was written with, text or blob (see storesBlobs), and comes back
+	// byte for byte
+	_, err = db.Exec("create table pairs (key blob, value blob);")
 
 	if err != nil {
 		log.Printf("error executing create table pairs command: %v\n", err)
@@ -54,74 +57,229 @@ func createDatabase(path string) (*sql.DB, error) {
 	return db, err
 }
 
-// OUTPUT NAMES DOES NOT CONTAIN 'tmp/'
-func splitDatabase(inputPath, outputPattern string, m int) ([]string, error) {
-	var inputDB *sql.DB
-	var outputDBs []*sql.DB
-	var outputNames []string
+// openReadOnly opens an input database that the job must not change
+func openReadOnly(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		log.Printf("error in openReadOnly: %v\n", err)
+	}
+	return db, err
+}
+
+// sqlSource is what splitDatabase reads from each input database: a table
+// with key and value columns, in rowid order, or a read-only SELECT whose
+// two columns are the key and the value, in the order it returns them. Either
+// way it is read once and cut into ranges of its rows.
+type sqlSource struct {
+	table string // [ex. pairs]
+	query string // [ex. SELECT name, age || ' ' || city FROM people]
+}
+
+func (s sqlSource) String() string {
+	if s.query != "" {
+		return "query " + s.query
+	}
+	return "table " + s.table
+}
+
+func (s sqlSource) quotedTable() string {
+	return `"` + strings.ReplaceAll(s.table, `"`, `""`) + `"`
+}
 
-	// open input database
-	inputDB, err := openDatabase(inputPath)
+// checks that db can be read the way s says and counts the pairs in it
+func (s sqlSource) check(db *sql.DB) (int, error) {
+	from := s.quotedTable()
+	shape := "SELECT key, value, rowid FROM " + from + " LIMIT 0"
+	if s.query != "" {
+		from = "(" + s.query + ")"
+		shape = "SELECT * FROM " + from + " LIMIT 0"
+	}
+	rows, err := db.Query(shape)
 	if err != nil {
-		log.Fatalf("error in splitDatabase opening input database: %v\n", err)
+		return 0, err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) != 2 && s.query != "" {
+		return 0, fmt.Errorf("query must yield two columns, the key and the value, not %d (%s)", len(columns), strings.Join(columns, ", "))
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM " + from).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// queries all the pairs in db, in order
+func (s sqlSource) rows(db *sql.DB) (*sql.Rows, error) {
+	if s.query != "" {
+		return db.Query(s.query)
+	}
+	return db.Query("SELECT key, value FROM " + s.quotedTable() + " ORDER BY rowid")
+}
+
+// the pairs of all inputs together are cut into ranges of about the same
+// size, one per output database [ex. data/tmp3410/map_0_source.db]
+func splitDatabase(inputPaths []string, source sqlSource, outputs []string) error {
+	m := len(outputs)
+	var outputDBs []*sql.DB
+	var inputDBs []*sql.DB
+
+	// close all databases on the way out
+	defer func() {
+		for _, db := range append(outputDBs, inputDBs...) {
+			db.Close()
+		}
+	}()
+
+	// make sure every input exists and has the source before creating anything
+	total := 0
+	for _, inputPath := range inputPaths {
+		if _, err := os.Stat(inputPath); err != nil {
+			return fmt.Errorf("input database %s: %v", inputPath, err)
+		}
+		db, err := openReadOnly(inputPath)
+		if err != nil {
+			return fmt.Errorf("error in splitDatabase opening input database %s: %v", inputPath, err)
+		}
+		inputDBs = append(inputDBs, db)
+		n, err := source.check(db)
+		if err != nil {
+			return fmt.Errorf("input database %s can't be read with %s: %v", inputPath, source, err)
+		}
+		total += n
 	}
 
-	// create pointers and names for output databases
-	for i := 0; i < m; i++ {
-		outputName := fmt.Sprintf(outputPattern, i)
-		outputNames = append(outputNames, strings.TrimPrefix(outputName, "data/tmp/"))
+	// create pointers for output databases
+	for _, outputName := range outputs {
 		db, err := createDatabase(outputName)
-		outputDBs = append(outputDBs, db)
 		if err != nil {
-			log.Fatalf("error in splitDatabase opening output databases: %v\n", err, outputName)
+			return fmt.Errorf("error in splitDatabase creating output database %s: %v", outputName, err)
 		}
+		outputDBs = append(outputDBs, db)
 	}
 
-	// runs input query and iterate over outputs inserting rows
-	var key, value string
-	databaseIndex := 0
+	// read each input once, handing its pairs out to the outputs in turn
 	keysProcessed := 0
-	rows, err := inputDB.Query(`SELECT key, value FROM pairs`)
+	for i, inputPath := range inputPaths {
+		n, err := copyInput(inputDBs[i], source, keysProcessed, total, outputDBs)
+		keysProcessed += n
+		if err != nil {
+			return fmt.Errorf("error in splitDatabase reading %s: %v", inputPath, err)
+		}
+	}
+
+	// final keys-processed check
+	if keysProcessed < m {
+		return errors.New(fmt.Sprintf("Not enough key-values processed: %v is less than expected %v or more", keysProcessed, m))
+	}
+	return nil
+}
+
+// copyInput copies the pairs of inputDB into the outputs, counting them
+// from first in all the inputs together: output k gets the pairs from the
+// total*k/m'th up to the total*(k+1)/m'th. It returns how many it copied.
+func copyInput(inputDB *sql.DB, source sqlSource, first, total int, outputDBs []*sql.DB) (int, error) {
+	rows, err := source.rows(inputDB)
 	if err != nil {
-		log.Fatalf("error in splitDatabase during query: %v", err)
+		return 0, err
 	}
-	for rows.Next() {
-		if err := rows.Scan(&key, &value); err != nil {
-			log.Fatalf("error in splitDatabase during scan: %v", err)
+	defer rows.Close()
+
+	m := len(outputDBs)
+	copied := 0
+	for k, outputDB := range outputDBs {
+		lo := max(total*k/m, first+copied)
+		hi := total * (k + 1) / m
+		if lo >= hi {
+			continue
 		}
-		databaseIndex %= m
-		db := outputDBs[databaseIndex]
-		_, err := db.Exec("insert into pairs (key, value) values (?, ?)", key, value)
+		n, err := copyRange(rows, hi-lo, outputDB)
+		copied += n
 		if err != nil {
-			log.Fatalf("error in splitDatabase during insert: %v", err)
+			return copied, err
+		}
+		if n < hi-lo {
+			break // the input ran out
 		}
-		databaseIndex++
-		keysProcessed++
 	}
+	return copied, rows.Err()
+}
 
-	// close all databases
-	for _, db := range outputDBs {
-		db.Close()
+// copyRange copies the next n pairs of rows (fewer if they run out) into
+// outputDB and returns how many it copied. Keys and values keep the type
+// they have in the input, except that a NULL becomes empty.
+func copyRange(rows *sql.Rows, n int, outputDB *sql.DB) (int, error) {
+	tx, err := outputDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("insert into pairs (key, value) values (?, ?)")
+	if err != nil {
+		return 0, err
 	}
-	inputDB.Close()
+	defer stmt.Close()
 
-	// final keys-processed check
-	var errCheck error
-	if keysProcessed < m {
-		errCheck = errors.New(fmt.Sprintf("Not enough key-values processed: %v is less than expected %v or more", keysProcessed, m))
+	keysProcessed := 0
+	for keysProcessed < n && rows.Next() {
+		var key, value interface{}
+		if err := rows.Scan(&key, &value); err != nil {
+			return keysProcessed, fmt.Errorf("error in splitDatabase during scan: %v", err)
+		}
+		if key == nil {
+			key = ""
+		}
+		if value == nil {
+			value = ""
+		}
+		if _, err := stmt.Exec(key, value); err != nil {
+			return keysProcessed, fmt.Errorf("error in splitDatabase during insert: %v", err)
+		}
+		keysProcessed++
 	}
+	return keysProcessed, tx.Commit()
+}
 
-	return outputNames, errCheck
+// FetchError reports a url that could not be downloaded because of the host
+// serving it (it is unreachable, or the file isn't there), as opposed to a
+// failure on the downloading end
+type FetchError struct {
+	Index int // position of URL in the urls given to mergeDatabases
+	URL   string
+	Err   error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.URL, e.Err)
+}
+
+// adds a metadata table of key/value pairs describing the job to db
+func writeMetadata(db *sql.DB, meta []Pair) error {
+	if _, err := db.Exec("create table metadata (key text, value text);"); err != nil {
+		return fmt.Errorf("error creating metadata table: %v", err)
+	}
+	for _, pair := range meta {
+		if _, err := db.Exec("insert into metadata (key, value) values (?, ?)", pair.Key, pair.Value); err != nil {
+			return fmt.Errorf("error writing metadata: %v", err)
+		}
+	}
+	return nil
 }
 
 // provide []string of COMPLETE urls [ex. http://localhost:8080/data/test.db],
 // path for output database [ex. tmp/mergedAusten.db],
-// temp string with full path [ex. tmp/test.db]
+// temp string with full path [ex. tmp/test.db];
+// nothing is left open if it fails
 func mergeDatabases(urls []string, path string, temp string) (*sql.DB, error) {
 	// create output database
 
 	fmt.Printf("\n\n")
-	
+
 	outputDB, err := createDatabase("data/" + path)
 	if err != nil {
 		log.Printf("error in mergeDatabase calling createDatabase: %v", err)
@@ -129,17 +287,23 @@ func mergeDatabases(urls []string, path string, temp string) (*sql.DB, error) {
 	}
 
 	// iteration over each url
-	for _, url := range urls {
+	for i, url := range urls {
 		// download into temp file
 		if err := download(url, temp); err != nil {
 			log.Printf("error in mergeDatabase calling download: %v", err)
-			return outputDB, err
+			outputDB.Close()
+			var fetchErr *FetchError
+			if errors.As(err, &fetchErr) {
+				fetchErr.Index = i
+			}
+			return nil, err
 		}
 
 		// merge into outputDB
 		if err := gatherInto(outputDB, temp); err != nil {
 			log.Printf("error in mergeDatabase calling gatherInto: %v", err)
-			return outputDB, err
+			outputDB.Close()
+			return nil, err
 		}
 
 		os.Remove(temp)
@@ -3,14 +3,17 @@ package mapreduce
 import (
 	"bufio"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type handler func(*Tasks)
@@ -21,17 +24,23 @@ type Server chan handler
 // Nothing is an empty struct for RPC purposes
 type Nothing struct{}
 
-
-
 // expects url => full http name [ex. http://localhost:8080/data/test.db],
-// path => full path name of new file [ex. tmp/test.db]
+// path => full path name of new file [ex. tmp/test.db];
+// failures on the serving end are returned as a *FetchError
 func download(url, path string) error {
 	// issue get request
 	// fmt.Printf("path: %v url: %v\n", path, url)
 	res, err := http.Get(url)
 	if err != nil {
 		log.Printf("error in download get request: %v", err)
-		return err
+		return &FetchError{URL: url, Err: err}
+	}
+	defer res.Body.Close()
+	// a missing file is an error, not a file holding the 404 page
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("GET %s: %s", url, res.Status)
+		log.Printf("error in download get request: %v", err)
+		return &FetchError{URL: url, Err: err}
 	}
 	// create file
 	newFile, err := os.Create("data/" + path)
@@ -39,16 +48,16 @@ func download(url, path string) error {
 		log.Printf("error in download file creation: %v", err)
 		return err
 	}
-	// copy from get response to file
+	defer newFile.Close()
+	// copy from get response to file; writing the file fails with a
+	// *os.PathError, anything else went wrong receiving it
 	if _, err := io.Copy(newFile, res.Body); err != nil {
 		log.Printf("error in download copying file: %v", err)
-		return err
-	}
-
-	err = res.Body.Close()
-	if err != nil {
-		log.Printf("error in download closing body: %v", err)
-		return err
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		return &FetchError{URL: url, Err: err}
 	}
 
 	return nil
@@ -91,7 +100,7 @@ func getLocalAddress() string {
 	return localAddr.IP.String()
 }
 
-func getInput(isMaster *bool, M, R *int, port, masterAddress, tempDir *string) {
+func getInput(cfg *Config) {
 	// get isMaster
 	var err error
 	scanner := bufio.NewScanner(os.Stdin)
@@ -100,51 +109,55 @@ func getInput(isMaster *bool, M, R *int, port, masterAddress, tempDir *string) {
 	line := scanner.Text()
 	line = strings.TrimSpace(line)
 	if line == "y" {
-		*isMaster = true
+		cfg.IsMaster = true
 	}
 	// if isMaster, get M and R
-	if *isMaster {
+	if cfg.IsMaster {
 		fmt.Printf("Number of Maptasks?\n")
 		scanner.Scan()
 		line = scanner.Text()
 		line = strings.TrimSpace(line)
-		if *M, err = strconv.Atoi(line); err != nil {
+		if cfg.M, err = strconv.Atoi(line); err != nil {
 			log.Fatalf("error parsing MapTasks during startup: %v", err)
 		}
 		fmt.Printf("Number of Reducetasks?\n")
 		scanner.Scan()
 		line = scanner.Text()
 		line = strings.TrimSpace(line)
-		if *R, err = strconv.Atoi(line); err != nil {
+		if cfg.R, err = strconv.Atoi(line); err != nil {
 			log.Fatalf("error parsing MapTasks during startup: %v", err)
 		}
+		// the prompts have always replaced the previous output
+		cfg.Overwrite = true
 	}
 	// get port
 	fmt.Printf("Port?\n")
 	scanner.Scan()
 	line = scanner.Text()
 	line = strings.TrimSpace(line)
-	*port = line
+	if cfg.IsMaster {
+		cfg.MasterPort = line
+	} else {
+		cfg.WorkerPort = line
+	}
 	// get master address
-	if !*isMaster {
+	if !cfg.IsMaster {
 		fmt.Printf("Master address?\n")
 		scanner.Scan()
 		line = scanner.Text()
 		line = strings.TrimSpace(line)
-		*masterAddress = line
+		cfg.Master = line
 	}
-	// get tempDir
-	*tempDir = fmt.Sprintf("tmp%s/", *port)
 }
 
 // shorten master code up a bit
-func splitInputFile(m int, filename string, tempDir string) error {
-	_, err := splitDatabase(filename, tempDir+"map_%d_source.db", m)
+func splitInputFile(inputs []InputSpec, inputOf []int, tempDir string) (Counters, error) {
+	counters, err := splitInputs(inputs, inputOf, tempDir)
 	if err != nil {
 		log.Printf("error splitting in main: %v\n", err)
-		return err
+		return nil, err
 	}
-	return nil
+	return counters, nil
 }
 
 // helpful for debugging/knowing what's going on
@@ -156,3 +169,86 @@ func printTasks(tasks *Tasks) {
 		fmt.Printf("Reduce: M-%v, R-%v, N-%v, SourceHosts-%v\n", tasks.RTasks[i].M, tasks.RTasks[i].R, tasks.RTasks[i].N, tasks.RTasks[i].SourceHosts)
 	}
 }
+
+// merges the databases at urls into name in the master's temp directory,
+// lets describe add tables about the job if it isn't nil, then moves the
+// result to dest following the job's overwrite policy
+func writeOutput(t *Tasks, urls []string, name, dest string, describe func(*sql.DB) error) error {
+	merged := t.TempDir + name
+	outputDB, err := mergeDatabases(urls, merged, t.TempDir+"finalOutputTemp.db")
+	if err != nil {
+		return err
+	}
+	if describe != nil {
+		err = describe(outputDB)
+	}
+	outputDB.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dest); err == nil && !t.Overwrite {
+		return fmt.Errorf("refusing to overwrite existing %s", dest)
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename("data/"+merged, dest)
+}
+
+// path of the database holding skipped records, next to the final output
+// [ex. data/finalOutput.db => data/finalOutput_quarantine.db]
+func quarantinePath(output string) string {
+	ext := path.Ext(output)
+	return strings.TrimSuffix(output, ext) + "_quarantine" + ext
+}
+
+// gathers the records skipped by the finished attempts into the quarantine
+// database, if any were skipped; otherwise an overwritten run's quarantine
+// is removed so it isn't taken for this output's
+func writeQuarantine(t *Tasks) error {
+	var urls []string
+	skipped := 0
+	for i, task := range t.MTasks {
+		if task.Skipped > 0 {
+			urls = append(urls, makeURL(task.FinishedBy, task.FinishedByDir, mapSkippedFile(i)))
+			skipped += task.Skipped
+		}
+	}
+	for i, task := range t.RTasks {
+		if task.Skipped > 0 {
+			urls = append(urls, makeURL(task.FinishedBy, task.FinishedByDir, reduceSkippedFile(i)))
+			skipped += task.Skipped
+		}
+	}
+	dest := quarantinePath(t.Output)
+	if len(urls) == 0 {
+		if !t.Overwrite {
+			return nil
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := writeOutput(t, urls, "quarantine.db", dest, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%d skipped records saved in %s\n", skipped, dest)
+	return nil
+}
+
+// shows the worker registry, to tell slow workers from dead ones
+func printWorkers(tasks *Tasks) {
+	for addr, w := range tasks.Workers {
+		state := "alive"
+		if !w.Alive {
+			state = "dead"
+		}
+		task := w.CurrentTask
+		if task == "" {
+			task = "idle"
+		}
+		fmt.Printf("Worker %s: %s, last seen %v ago, %s, %d tasks completed\n", addr, state, time.Since(w.LastSeen).Round(time.Second), task, w.Completed)
+	}
+}
@@ -0,0 +1,351 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// input formats the master can split into map tasks
+const (
+	SQLiteInput = "sqlite" // databases with a pairs (key, value) table
+	TextInput   = "text"   // text files, one record per line, which may be compressed (.gz or .zst)
+)
+
+var inputFormats = []string{SQLiteInput, TextInput, JSONLInput, CSVInput}
+
+// InputSpec is one of the inputs of a job. A job can read several at once,
+// in different formats [ex. a users database and a directory of csv
+// orders to join them on], and Map sees which one a record came from in
+// TaskContext.Input.
+type InputSpec struct {
+	Name   string   `json:"name"`   // [ex. "users"]
+	Paths  []string `json:"paths"`  // databases, or files, directories and globs
+	Format string   `json:"format"` // "sqlite" (default), "text", "jsonl" or "csv"
+	Fields Fields   `json:"fields"` // how jsonl and csv records become pairs
+	Table  string   `json:"table"`  // table of sqlite inputs (default pairs)
+	Query  string   `json:"query"`  // read-only SELECT on sqlite inputs, instead of Table
+}
+
+// check validates the input and fills in its defaults
+func (in *InputSpec) check() error {
+	if in.Name == "" {
+		return errors.New("every input needs a name")
+	}
+	if len(in.Paths) == 0 {
+		return fmt.Errorf("input %s has no paths", in.Name)
+	}
+	if in.Format == "" {
+		in.Format = SQLiteInput
+	}
+	if !slices.Contains(inputFormats, in.Format) {
+		return fmt.Errorf("input %s: unknown format %q (use %s)", in.Name, in.Format, strings.Join(inputFormats, ", "))
+	}
+	if in.Query != "" {
+		if in.Format != SQLiteInput {
+			return fmt.Errorf("input %s: a query only reads sqlite inputs, not %s", in.Name, in.Format)
+		}
+		if words := strings.Fields(in.Query); len(words) == 0 || !strings.EqualFold(words[0], "select") && !strings.EqualFold(words[0], "with") {
+			return fmt.Errorf("input %s: the query must be a SELECT", in.Name)
+		}
+	} else if in.Table == "" {
+		in.Table = "pairs"
+	}
+	return nil
+}
+
+// the files the input reads
+func (in *InputSpec) files() ([]string, error) {
+	if in.Format == SQLiteInput {
+		return in.Paths, nil
+	}
+	return expandInputs(in.Paths)
+}
+
+// the input's share of the map tasks goes by how many bytes its files take up
+func (in *InputSpec) size() (int64, error) {
+	files, err := in.files()
+	if err != nil {
+		return 0, fmt.Errorf("input %s: %v", in.Name, err)
+	}
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("input %s: %v", in.Name, err)
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// splits the input into outputs, the source databases of its map tasks,
+// and returns the counters of the split
+func (in *InputSpec) split(outputs []string) (Counters, error) {
+	switch in.Format {
+	case TextInput:
+		return nil, splitText(in.Paths, outputs)
+	case JSONLInput, CSVInput:
+		return splitRecords(in.Format, &in.Fields, in.Paths, outputs)
+	default:
+		return nil, splitDatabase(in.Paths, sqlSource{table: in.Table, query: in.Query}, outputs)
+	}
+}
+
+func (in *InputSpec) String() string {
+	return in.Format + " " + strings.Join(in.Paths, ",")
+}
+
+// spreadInputs hands out m map tasks to the inputs in proportion to their
+// sizes, at least one each, and returns the input of every task; an input's
+// tasks come one after the other
+func spreadInputs(inputs []InputSpec, m int) ([]int, error) {
+	sizes := make([]int64, len(inputs))
+	for i := range inputs {
+		size, err := inputs[i].size()
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = max(size, 1)
+	}
+
+	// each task after the first of every input goes to the input whose tasks
+	// would otherwise be the biggest
+	counts := make([]int, len(inputs))
+	for i := range counts {
+		counts[i] = 1
+	}
+	for n := len(inputs); n < m; n++ {
+		biggest := 0
+		for i := range sizes {
+			if sizes[i]*int64(counts[biggest]) > sizes[biggest]*int64(counts[i]) {
+				biggest = i
+			}
+		}
+		counts[biggest]++
+	}
+
+	var inputOf []int
+	for i, n := range counts {
+		for ; n > 0; n-- {
+			inputOf = append(inputOf, i)
+		}
+	}
+	return inputOf, nil
+}
+
+// splits every input into the source databases of its map tasks in
+// tempDir, and returns the counters of all the splits
+func splitInputs(inputs []InputSpec, inputOf []int, tempDir string) (Counters, error) {
+	counters := make(Counters)
+	for i := range inputs {
+		var outputs []string
+		for n, input := range inputOf {
+			if input == i {
+				outputs = append(outputs, tempDir+mapSourceFile(n))
+			}
+		}
+		c, err := inputs[i].split(outputs)
+		if err != nil {
+			return nil, err
+		}
+		counters.add(c)
+	}
+	return counters, nil
+}
+
+// expandInputs turns the inputs of a file-based job into the files they
+// name, in order: a directory stands for the files directly inside it and a
+// glob pattern for the files it matches
+func expandInputs(inputs []string) ([]string, error) {
+	var files []string
+	for _, input := range inputs {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("bad input pattern %s: %v", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input %s: no such file", input)
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("input %s: %v", match, err)
+			}
+			if !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, fmt.Errorf("input %s: %v", match, err)
+			}
+			for _, entry := range entries {
+				if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no input files in %s", strings.Join(inputs, ", "))
+	}
+	return files, nil
+}
+
+// fileSplit is a byte range of an input file, of its decompressed content
+// if it is compressed
+type fileSplit struct {
+	path       string
+	start, end int64
+	frames     []zstdFrame // of a zstd file, to start reading at the right one
+}
+
+// splitFiles cuts files into m splits of about the same number of bytes, as
+// if they were one long file; a split that runs from the end of one file
+// into the next gets a piece of each. Compressed files are only cut where
+// they can be read from (see fileLayout).
+func splitFiles(files []string, m int) ([][]fileSplit, error) {
+	sizes := make([]int64, len(files))
+	var total int64
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %v", file, err)
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+
+	splits := make([][]fileSplit, m)
+	var base int64 // where the file starts in all the files together
+	for i, file := range files {
+		layout, err := layoutOf(file, sizes[i])
+		if err != nil {
+			return nil, err
+		}
+		for k := 0; k < m; k++ {
+			lo := layout.snap(min(max(total*int64(k)/int64(m)-base, 0), sizes[i]))
+			hi := layout.snap(min(max(total*int64(k+1)/int64(m)-base, 0), sizes[i]))
+			if lo < hi {
+				splits[k] = append(splits[k], layout.split(lo, hi))
+			}
+		}
+		base += sizes[i]
+	}
+	return splits, nil
+}
+
+// readLines calls emit with each line that starts inside the split and its
+// offset in the file (in decompressed bytes). A line is read to its end even
+// past the end of the split, and the one the split starts in the middle of
+// is left to the split before, so every line is read exactly once.
+func readLines(split fileSplit, emit func(offset int64, line []byte) error) error {
+	// back up one byte: if it ends a line the split starts on a fresh one
+	offset := split.start
+	if offset > 0 {
+		offset--
+	}
+	f, closeSplit, err := openSplit(split, offset)
+	if err != nil {
+		return err
+	}
+	defer closeSplit()
+	r := bufio.NewReader(f)
+	if split.start > 0 {
+		skipped, err := r.ReadBytes('\n')
+		offset += int64(len(skipped))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for offset < split.end {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := emit(offset, trimNewline(line)); err != nil {
+				return err
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drops the "\n" or "\r\n" ending a line
+func trimNewline(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// splitText writes the lines of the text inputs into the outputs for the
+// map tasks, keyed "file:offset" with the line as the value. The files are
+// cut into byte ranges of about the same size, lined up on line breaks.
+func splitText(inputs []string, outputs []string) error {
+	files, err := expandInputs(inputs)
+	if err != nil {
+		return err
+	}
+	splits, err := splitFiles(files, len(outputs))
+	if err != nil {
+		return err
+	}
+
+	lines := 0
+	for i, pieces := range splits {
+		n, err := writeTextSplit(outputs[i], pieces)
+		lines += n
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Split %d lines from %d files into %d map tasks\n", lines, len(files), len(outputs))
+	return nil
+}
+
+// writes the lines of pieces into a new pairs database at path and returns
+// how many there were
+func writeTextSplit(path string, pieces []fileSplit) (int, error) {
+	db, err := createDatabase(path)
+	if err != nil {
+		return 0, fmt.Errorf("error creating map input %s: %v", path, err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("insert into pairs (key, value) values (?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	n := 0
+	for _, piece := range pieces {
+		err := readLines(piece, func(offset int64, line []byte) error {
+			n++
+			_, err := stmt.Exec([]byte(fmt.Sprintf("%s:%d", piece.path, offset)), line)
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("error splitting %s: %v", piece.path, err)
+		}
+	}
+	return n, tx.Commit()
+}
@@ -0,0 +1,183 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the ways the tests cut their inputs, from one split to more splits than
+// some files have lines
+var splitCounts = []int{1, 2, 3, 7, 13, 100}
+
+// text with the kinds of lines splits have to get right: empty ones, "\r\n"
+// endings, lines longer than a read buffer and a last line without a newline
+func testText(lines int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < lines; i++ {
+		switch i % 7 {
+		case 0:
+			b.WriteString("\n")
+		case 3:
+			fmt.Fprintf(&b, "line %d ends in crlf\r\n", i)
+		case 5:
+			fmt.Fprintf(&b, "line %d %s\n", i, strings.Repeat("x", 5000))
+		default:
+			fmt.Fprintf(&b, "line %d %s\n", i, strings.Repeat("y", i%50))
+		}
+	}
+	b.WriteString("no newline at the end")
+	return b.Bytes()
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// the lines of content as "path:offset:line", the way splits should read them
+func linesOf(path string, content []byte) []string {
+	var lines []string
+	for offset := 0; offset < len(content); {
+		n := bytes.IndexByte(content[offset:], '\n') + 1
+		if n == 0 {
+			n = len(content) - offset
+		}
+		line := bytes.TrimSuffix(bytes.TrimSuffix(content[offset:offset+n], []byte("\n")), []byte("\r"))
+		lines = append(lines, fmt.Sprintf("%s:%d:%s", path, offset, line))
+		offset += n
+	}
+	return lines
+}
+
+// cuts files into m splits and reads them all back, in order
+func readSplits(t *testing.T, files []string, m int) []string {
+	t.Helper()
+	splits, err := splitFiles(files, m)
+	if err != nil {
+		t.Fatalf("splitFiles into %d: %v", m, err)
+	}
+	if len(splits) != m {
+		t.Fatalf("splitFiles into %d made %d splits", m, len(splits))
+	}
+	var got []string
+	for _, pieces := range splits {
+		for _, piece := range pieces {
+			err := readLines(piece, func(offset int64, line []byte) error {
+				got = append(got, fmt.Sprintf("%s:%d:%s", piece.path, offset, line))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("m=%d: reading %s from %d to %d: %v", m, piece.path, piece.start, piece.end, err)
+			}
+		}
+	}
+	return got
+}
+
+// every line has to come back exactly once, in order
+func checkLines(t *testing.T, m int, got, want []string) {
+	t.Helper()
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(got):
+			t.Errorf("m=%d: %d lines read, missing %.60q and %d more", m, len(got), want[i], len(want)-i-1)
+		case i >= len(want):
+			t.Errorf("m=%d: %d lines read, %d too many starting with %.60q", m, len(got), len(got)-len(want), got[i])
+		case got[i] != want[i]:
+			t.Errorf("m=%d: line %d is %.60q, want %.60q", m, i, got[i], want[i])
+		default:
+			continue
+		}
+		return
+	}
+}
+
+func TestReadLinesOnce(t *testing.T) {
+	dir := t.TempDir()
+	// short lines put split boundaries right at the start of some lines
+	contents := [][]byte{testText(300), {}, []byte("a single line"), bytes.Repeat([]byte("\n"), 50),
+		bytes.Repeat([]byte("ab\n"), 40), testText(40)}
+	var files, want []string
+	for i, content := range contents {
+		path := writeFile(t, filepath.Join(dir, fmt.Sprintf("%d.txt", i)), content)
+		files = append(files, path)
+		want = append(want, linesOf(path, content)...)
+
+		// on its own, so the splits fall inside the short files too
+		for _, m := range splitCounts {
+			checkLines(t, m, readSplits(t, []string{path}, m), linesOf(path, content))
+		}
+	}
+
+	for _, m := range splitCounts {
+		checkLines(t, m, readSplits(t, files, m), want)
+	}
+}
+
+func TestSplitFilesCoversFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, filepath.Join(dir, "a.txt"), testText(100))
+	b := writeFile(t, filepath.Join(dir, "b.txt"), testText(10))
+
+	for _, m := range splitCounts {
+		splits, err := splitFiles([]string{a, b}, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the pieces of each file follow on from each other without gaps
+		next := map[string]int64{}
+		for _, pieces := range splits {
+			for _, piece := range pieces {
+				if piece.start != next[piece.path] || piece.end <= piece.start {
+					t.Fatalf("m=%d: piece of %s from %d to %d, want one from %d", m, piece.path, piece.start, piece.end, next[piece.path])
+				}
+				next[piece.path] = piece.end
+			}
+		}
+		for _, file := range []string{a, b} {
+			info, _ := os.Stat(file)
+			if next[file] != info.Size() {
+				t.Errorf("m=%d: pieces of %s end at %d, not at its size %d", m, file, next[file], info.Size())
+			}
+		}
+	}
+}
+
+func TestSpreadInputs(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []InputSpec
+	for i, size := range []int{6000, 2000, 1000, 0} {
+		path := writeFile(t, filepath.Join(dir, fmt.Sprintf("%d.txt", i)), bytes.Repeat([]byte("x\n"), size/2))
+		inputs = append(inputs, InputSpec{Name: fmt.Sprint(i), Paths: []string{path}, Format: TextInput})
+	}
+
+	tests := []struct {
+		m    int
+		want []int
+	}{
+		{4, []int{0, 1, 2, 3}},
+		{5, []int{0, 0, 1, 2, 3}},
+		{10, []int{0, 0, 0, 0, 0, 0, 1, 1, 2, 3}},
+	}
+	for _, test := range tests {
+		inputOf, err := spreadInputs(inputs, test.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(inputOf, test.want) {
+			t.Errorf("m=%d: tasks go to inputs %v, want %v", test.m, inputOf, test.want)
+		}
+	}
+
+	if _, err := spreadInputs([]InputSpec{{Name: "missing", Paths: []string{filepath.Join(dir, "nope.txt")}, Format: TextInput}}, 2); err == nil {
+		t.Error("spreading a missing input did not fail")
+	}
+}
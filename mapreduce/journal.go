@@ -0,0 +1,197 @@
+package mapreduce
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"time"
+)
+
+// journal keeps a copy of the master's scheduling state in a sqlite
+// database. The actor saves to it after every handler that changed Tasks, so
+// a master that restarts can reload the job and carry on.
+type journal struct {
+	path string
+	name string // the job the journal belongs to
+	db   *sql.DB
+	last []byte // last snapshot written
+}
+
+// snapshot is the part of Tasks that is worth keeping across a restart
+type snapshot struct {
+	// what the job is; a journal only resumes the same job
+	Name        string
+	M, R        int
+	Inputs      []InputSpec
+	Output      string
+	Partitioner string
+	Sorted      bool
+	Params      map[string]string
+
+	MTasks     []MapTask
+	RTasks     []ReduceTask
+	Workers    map[string]WorkerInfo // without LastSeen, which changes on every heartbeat
+	Backups    int
+	BackupWins int
+	// counters of splitting the input, which a resumed job doesn't redo
+	InputCounters Counters
+}
+
+func journalPath(cfg *Config) string {
+	if cfg.Journal != "" {
+		return cfg.Journal
+	}
+	return fmt.Sprintf("data/%s.journal.db", cfg.Name)
+}
+
+// opens the journal of job name at path, creating it if needed
+func openJournal(path, name string) (*journal, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000&_synchronous=FULL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("create table if not exists journal (id integer primary key, snapshot text);"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating journal table in %s: %v", path, err)
+	}
+	return &journal{path: path, name: name, db: db}, nil
+}
+
+func (j *journal) snapshot(t *Tasks) snapshot {
+	s := snapshot{Name: j.name, M: len(t.MTasks), R: len(t.RTasks), Inputs: t.Inputs, Output: t.Output,
+		Partitioner: t.Partitioner, Sorted: t.Sorted, Params: t.Params, MTasks: t.MTasks, RTasks: t.RTasks,
+		Workers: make(map[string]WorkerInfo), Backups: t.Backups, BackupWins: t.BackupWins, InputCounters: t.InputCounters}
+	for addr, w := range t.Workers {
+		w := *w
+		w.LastSeen = time.Time{}
+		s.Workers[addr] = w
+	}
+	return s
+}
+
+// names the first thing that makes the job of other a different one from
+// the job of s, or returns "" if they are the same. A sorted job's
+// partitioner is made from its input, so only the sort setting is compared.
+func (s *snapshot) differs(other *snapshot) string {
+	inputs, _ := json.Marshal(s.Inputs)
+	otherInputs, _ := json.Marshal(other.Inputs)
+	switch {
+	case s.Name != other.Name:
+		return "name"
+	case s.M != other.M || s.R != other.R:
+		return "number of map or reduce tasks"
+	case !bytes.Equal(inputs, otherInputs):
+		return "inputs"
+	case s.Output != other.Output:
+		return "output"
+	case s.Sorted != other.Sorted:
+		return "sort setting"
+	case !s.Sorted && s.Partitioner != other.Partitioner:
+		return "partitioner"
+	case !maps.Equal(s.Params, other.Params):
+		return "params"
+	}
+	return ""
+}
+
+// writes the state of t if it changed since the last save
+func (j *journal) save(t *Tasks) {
+	data, err := json.Marshal(j.snapshot(t))
+	if err != nil {
+		log.Printf("error encoding journal snapshot: %v", err)
+		return
+	}
+	if bytes.Equal(data, j.last) {
+		return
+	}
+	if _, err := j.db.Exec("insert or replace into journal (id, snapshot) values (1, ?)", string(data)); err != nil {
+		log.Printf("error writing journal %s: %v", j.path, err)
+		return
+	}
+	j.last = data
+}
+
+// loads a previous run's state into t; reports false if there was none
+func (j *journal) load(t *Tasks) (bool, error) {
+	var data string
+	err := j.db.QueryRow("select snapshot from journal where id = 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error reading journal %s: %v", j.path, err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return false, fmt.Errorf("error decoding journal %s: %v", j.path, err)
+	}
+	current := j.snapshot(t)
+	if diff := s.differs(&current); diff != "" {
+		return false, fmt.Errorf("journal %s belongs to another run of job %s (the %s changed), remove it to start over", j.path, s.Name, diff)
+	}
+
+	t.MTasks, t.RTasks = s.MTasks, s.RTasks
+	t.Backups, t.BackupWins = s.Backups, s.BackupWins
+	t.InputCounters = s.InputCounters
+
+	// running attempts get a fresh lease, which their workers' heartbeats
+	// renew if they are still at it
+	deadline := time.Now().Add(t.LeaseTimeout)
+	for i := range t.MTasks {
+		for l := range t.MTasks[i].Leases {
+			t.MTasks[i].Leases[l].Deadline = deadline
+		}
+	}
+	for i := range t.RTasks {
+		for l := range t.RTasks[i].Leases {
+			t.RTasks[i].Leases[l].Deadline = deadline
+		}
+	}
+
+	// workers get a fresh heartbeat timeout to reconnect in
+	for addr, w := range s.Workers {
+		w := w
+		w.LastSeen = time.Now()
+		t.Workers[addr] = &w
+	}
+	j.last = []byte(data)
+	return true, nil
+}
+
+// closes and deletes the journal once the job is over
+func (j *journal) remove() {
+	j.db.Close()
+	if err := os.Remove(j.path); err != nil {
+		log.Printf("error removing journal %s: %v", j.path, err)
+	}
+}
+
+// checks that the outputs a reloaded journal says are finished can still be
+// downloaded, and re-executes the tasks whose outputs are gone
+func verifyOutputs(t *Tasks) {
+	client := http.Client{Timeout: 5 * time.Second}
+	exists := func(url string) bool {
+		res, err := client.Head(url)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}
+
+	for i, rT := range t.RTasks {
+		if rT.Finished && !exists(makeURL(rT.FinishedBy, rT.FinishedByDir, reduceOutputFile(i))) {
+			t.reopenReduce(i, "is gone")
+		}
+	}
+	for i, mT := range t.MTasks {
+		if mT.Finished && !exists(makeURL(mT.FinishedBy, mT.FinishedByDir, mapOutputFile(i, 0))) {
+			t.reopenMap(i, "is gone")
+		}
+	}
+}
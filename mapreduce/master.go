@@ -1,20 +1,44 @@
 package mapreduce
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"time"
 	"path"
+	"time"
 )
 
 type Tasks struct {
 	MTasks       []MapTask
 	RTasks       []ReduceTask
 	Finished     bool
-	AliveWorkers int
-	FinChannel   *chan Nothing
+	Workers      map[string]*WorkerInfo // registry of workers by address
+	FinChannel   *chan error            // receives nil when the job succeeds, or why it failed
+	TempDir      string                 // master's temporary directory inside data/
+	Inputs       []InputSpec            // what the job reads
+	Output       string                 // path of the final output database
+	Overwrite    bool                   // replace Output if it already exists
+	LeaseTimeout time.Duration          // how long an attempt may go without a heartbeat before it is presumed lost
+	// how long a worker may go without a heartbeat before it is presumed dead
+	HeartbeatTimeout time.Duration
+	// a running task gets a backup attempt once it runs this many times longer
+	// than the median task of its phase (0 turns backups off)
+	StragglerFactor float64
+	Backups         int // backup attempts launched
+	BackupWins      int // backup attempts that finished before the original
+	MaxFailures     int // a task failing this many times fails the job
+	// skip a record once it has made its task fail this many times (0 = never)
+	SkipAfter   int
+	journal     *journal          // where the actor saves the state, nil once the job is over
+	Name        string            // job name
+	Partitioner string            // name of the partitioner the job uses
+	Sorted      bool              // the output is sorted as a whole (total-order mode)
+	Params      map[string]string // job parameters handed out with every task
+	// counters of splitting the input [ex. records that couldn't be read]
+	InputCounters Counters
 }
 
 type Task struct {
@@ -22,16 +46,41 @@ type Task struct {
 	MTask    MapTask
 	IsMap    bool
 	GotATask bool
+	Attempt  int               // attempt number to report back when finished
+	Params   map[string]string // job parameters
 }
 
 type Shutdown struct {
 	Ok bool
 }
 
-type Notification struct {
+// FetchFailure is sent instead of a Notification when a reduce task could
+// not download the output of one of the map tasks
+type FetchFailure struct {
+	TaskN   int // the reduce task
+	Attempt int
+	Address string
+	Map     int    // the map task whose output was missing
+	Host    string // where the map output should have been
+}
+
+// TaskFailure is sent instead of a Notification when a task attempt fails
+type TaskFailure struct {
+	IsMap   bool
 	TaskN   int
+	Attempt int
 	Address string
-	Port    string
+	Err     string
+	Key     string // the record the client's Map or Reduce failed on, if known
+}
+
+type Notification struct {
+	TaskN    int
+	Attempt  int
+	Address  string
+	TempDir  string
+	Skipped  int      // records quarantined instead of processed
+	Counters Counters // counters of the finished attempt
 }
 
 /*
@@ -40,32 +89,58 @@ EXAMPLES OF CURL COMMAND:
 	- curl http://192.168.0.241:3410/data/austen.db
 */
 
+// Start runs this process as a master or a worker for client. A client that
+// also implements ContextInterface is run through that instead.
 func Start(client Interface) error {
+	if contextClient, ok := client.(ContextInterface); ok {
+		return StartContext(contextClient)
+	}
+	return StartContext(legacyClient{client})
+}
 
-	var isMaster bool
-	var M, R int
-	var port, masterAddress, tempDir string
+// StartContext is Start for clients written against ContextInterface
+func StartContext(client ContextInterface) error {
 
-	// runs command-input type of startup
-	getInput(&isMaster, &M, &R, &port, &masterAddress, &tempDir)
+	// reads the subcommand, flags and job spec (or prompts if there are none)
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
 
-	if isMaster { // Master
-		if err := runMaster(M, R, port, tempDir); err != nil {
-			log.Fatalf("error during master run: %v", err)
+	if cfg.IsMaster { // Master
+		if err := runMaster(cfg, client); err != nil {
+			return fmt.Errorf("error during master run: %v", err)
 		}
 	} else { // Worker
-		if err := runWorker(port, masterAddress, tempDir, client); err != nil {
-			log.Fatalf("error during worker run: %v", err)
+		if err := runWorker(cfg, client); err != nil {
+			return fmt.Errorf("error during worker run: %v", err)
 		}
 	}
 
 	return nil
 }
 
-func runMaster(M, R int, port, tempDir string) error {
+func runMaster(cfg *Config, client ContextInterface) error {
+	M, R, tempDir := cfg.M, cfg.R, cfg.TempDir
+	partitioner := partitionerName(clientPartitioner(client))
+
 	// Get Address
-	masterAddress := "localhost:" + port
-	fmt.Printf("\nStarting master at address: %s\n", masterAddress)
+	masterAddress := "localhost:" + cfg.MasterPort
+	fmt.Printf("\nStarting master for job %s at address: %s\n", cfg.Name, masterAddress)
+
+	// refuse to clobber a previous output, or the skipped records saved next
+	// to it, unless asked to
+	for _, dest := range []string{cfg.Output, quarantinePath(cfg.Output)} {
+		if _, err := os.Stat(dest); err == nil && !cfg.Overwrite {
+			return fmt.Errorf("output %s already exists (use -overwrite to replace it)", dest)
+		}
+	}
+
+	// a total-order sort range partitions on whole keys, which would split
+	// the groups of a Grouper across reduce tasks
+	if _, ok := clientImpl(client).(Grouper); ok && cfg.Sort {
+		return errors.New("a client with GroupKey can't sort the whole output (-sort), its groups would be split across reduce tasks")
+	}
 
 	// get current directory
 	currDirectory, err := os.Getwd()
@@ -79,51 +154,111 @@ func runMaster(M, R int, port, tempDir string) error {
 		log.Fatalf("error making directory in Master: %v", err)
 	}
 
-	// Delete last output file
-	if err := os.Remove(dataPath + "/finalOutput.db"); err != nil {
-		fmt.Printf("Failed to delete previous finalOutput.db: %v\n", err)
-	}
 	defer os.RemoveAll(dataPath + "/" + tempDir)
 
-	// split input file
-	splitInputFile(M, "data/austen.db", "data/"+tempDir)
-
 	// generate map/reduce tasks
 	// finChannel indicates finishing of the entire mapreduce process
-	finChannel := make(chan Nothing)
-	tasksMaster := Tasks{MTasks: make([]MapTask, M), RTasks: make([]ReduceTask, R), FinChannel: &finChannel}
+	finChannel := make(chan error)
+	tasksMaster := Tasks{MTasks: make([]MapTask, M), RTasks: make([]ReduceTask, R), FinChannel: &finChannel, TempDir: tempDir,
+		Inputs: cfg.Inputs, Output: cfg.Output, Overwrite: cfg.Overwrite, LeaseTimeout: cfg.Lease.Duration,
+		Workers: make(map[string]*WorkerInfo), HeartbeatTimeout: cfg.HeartbeatTimeout.Duration, StragglerFactor: cfg.Straggler, MaxFailures: cfg.MaxFailures, SkipAfter: cfg.SkipAfter,
+		Name: cfg.Name, Partitioner: partitioner, Sorted: cfg.Sort, Params: cfg.Params}
+	// spread the map tasks over the inputs
+	inputOf, err := spreadInputs(cfg.Inputs, M)
+	if err != nil {
+		return err
+	}
 	for i := 0; i < M; i++ {
-		mTask := MapTask{M: M, R: R, N: i, SourceHost: masterAddress, Finished: false, SourcePort: port}
+		mTask := MapTask{M: M, R: R, N: i, SourceHost: masterAddress, Finished: false, SourceDir: tempDir, Partitioner: partitioner,
+			Input: cfg.Inputs[inputOf[i]].Name}
 		tasksMaster.MTasks[i] = mTask
 	}
 	for i := 0; i < R; i++ {
-		rTask := ReduceTask{M: M, R: R, N: i, Finished: false, SourceHosts: make([]string, M), SourcePorts: make([]string, M)}
+		rTask := ReduceTask{M: M, R: R, N: i, Finished: false, SourceHosts: make([]string, M), SourceDirs: make([]string, M)}
 		tasksMaster.RTasks[i] = rTask
 	}
 
-	// host http file server
-	go func() {
-		http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(dataPath))))
-		if err := http.ListenAndServe(masterAddress, nil); err != nil {
-			log.Printf("Error in HTTP server for %s: %v", masterAddress, err)
+	// pick up where a previous master left off if it left a journal
+	jrnl, err := openJournal(journalPath(cfg), cfg.Name)
+	if err != nil {
+		return err
+	}
+	resumed, err := jrnl.load(&tasksMaster)
+	if err != nil {
+		jrnl.db.Close()
+		return err
+	}
+	tasksMaster.journal = jrnl
+	if resumed {
+		fmt.Printf("Resuming job %s from %s\n", cfg.Name, jrnl.path)
+		verifyOutputs(&tasksMaster)
+		printWorkers(&tasksMaster)
+	}
+
+	// split input files, unless the splits survived the restart
+	split := !resumed
+	for i := 0; i < M && !split; i++ {
+		if _, err := os.Stat("data/" + tempDir + mapSourceFile(i)); err != nil {
+			split = true
 		}
-	}()
+	}
+	if split {
+		if tasksMaster.InputCounters, err = splitInputFile(cfg.Inputs, inputOf, "data/"+tempDir); err != nil {
+			return err
+		}
+	}
+
+	// a total-order sort range partitions on split points sampled from the
+	// input (a resumed job keeps the ones it had)
+	if cfg.Sort && !resumed {
+		splits, err := sampleSplits("data/"+tempDir, M, R, clientKeyOrder(client))
+		if err != nil {
+			return err
+		}
+		ranges := partitionerName(RangePartitioner{Splits: splits})
+		for i := range tasksMaster.MTasks {
+			tasksMaster.MTasks[i].Sort = true
+			tasksMaster.MTasks[i].Splits = splits
+			tasksMaster.MTasks[i].Partitioner = ranges
+		}
+		fmt.Printf("Sorting on %d split points sampled from the input\n", len(splits))
+	}
+	tasksMaster.Partitioner = tasksMaster.MTasks[0].Partitioner
+
+	// host http file server (served by the RPC server's listener, they share an address)
+	http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(dataPath))))
 
 	// start RPC server with actor
-	_ = rpcServer(masterAddress, &tasksMaster)
+	actor := rpcServer(masterAddress, &tasksMaster)
+
+	// requeue tasks whose lease ran out
+	go actor.watch(time.Second)
+
+	// the previous master may have died with nothing left but the final merge
+	if resumed {
+		*actor <- func(t *Tasks) {
+			t.checkDone()
+		}
+	}
 
 	fmt.Printf("Server Now Online!\n\n")
 
 	// recieve inidcation of finished program from finChannel, wait to shut down so the workers have time
-	<-*tasksMaster.FinChannel
+	jobErr := <-*tasksMaster.FinChannel
 	time.Sleep(time.Second * 3)
+	if jobErr != nil {
+		fmt.Printf("\n\nMapReduce Failed! Shutting Down...\n\n")
+		return fmt.Errorf("job %s failed: %v", cfg.Name, jobErr)
+	}
 	fmt.Printf("\n\nMapReduce Finished! Shutting Down...\n\n")
 	return nil
 }
 
-func runWorker(port, masterAddress, tempDir string, client Interface) error {
+func runWorker(cfg *Config, client ContextInterface) error {
+	masterAddress, tempDir, patience := cfg.Master, cfg.TempDir, cfg.Patience.Duration
+
 	// get address for worker
-	currentAddress := getLocalAddress() + ":" + port
+	currentAddress := getLocalAddress() + ":" + cfg.WorkerPort
 	fmt.Printf("\nStarting worker at address: %s\n\n", currentAddress)
 
 	// get current directory
@@ -147,11 +282,19 @@ func runWorker(port, masterAddress, tempDir string, client Interface) error {
 
 	// initialize shutdown object and notify server of existence
 	shutdown := Shutdown{Ok: false}
+	self := Notification{Address: currentAddress, TempDir: tempDir}
 	var junk Nothing
-	if err := call(masterAddress, "Server.Ping", &junk, &junk); err != nil {
+	if err := callRetry(masterAddress, "Server.Ping", &self, &junk, patience); err != nil {
 		log.Fatalf("Failed to get task: %v", err)
 	}
 
+	// keep telling the master we're alive until we shut down, and what we're
+	// running so it can call off attempts it no longer needs
+	running := runningTask{status: Status{Address: currentAddress}}
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go heartbeat(masterAddress, &running, cfg.Heartbeat.Duration, stopHeartbeat)
+
 	// Run this loop while shutdown.Ok is false (Master has not indicated to shutdown)
 	// PreviouslySlept is a way to make it so that the waiting for Master message doesn't flood the console
 	previouslySlept := false
@@ -160,30 +303,67 @@ func runWorker(port, masterAddress, tempDir string, client Interface) error {
 		// Get a task
 		var junk Nothing
 		task := Task{}
-		if err := call(masterAddress, "Server.GetTask", &junk, &task); err != nil {
+		if err := callRetry(masterAddress, "Server.GetTask", &self, &task, patience); err != nil {
 			log.Fatalf("Failed to get task: %v", err)
 		}
 
 		// Process as either a Map task or a Reduce task
 		if task.GotATask && task.IsMap {
 			previouslySlept = false
-			fmt.Printf("MapTask %d Recieved.\nProcessing... \n", task.MTask.N)
-			task.MTask.Process(tempDir, client)
+			fmt.Printf("MapTask %d (attempt %d) Recieved.\nProcessing... \n", task.MTask.N, task.Attempt)
+			resetCounters()
+			ctx := running.start(Status{Address: currentAddress, IsMap: true, TaskN: task.MTask.N, Attempt: task.Attempt})
+			taskCtx := newTaskContext(ctx, task.Params, fmt.Sprintf("map %d", task.MTask.N), task.Attempt)
+			taskCtx.Input = task.MTask.Input
+			err := task.MTask.Process(tempDir, client, taskCtx)
+			running.stop()
+			if errors.Is(err, context.Canceled) {
+				fmt.Printf("Cancelled.\n\n")
+				continue
+			} else if err != nil {
+				reportFailure(masterAddress, patience, err, &TaskFailure{IsMap: true, TaskN: task.MTask.N, Attempt: task.Attempt, Address: currentAddress})
+				continue
+			}
+			counters := takeCounters()
+			counters.print()
 			fmt.Printf("Finished.\n\n")
 
-			notification := Notification{TaskN: task.MTask.N, Address: currentAddress, Port: port}
-			if err := call(masterAddress, "Server.NotifyMapFinished", &notification, &junk); err != nil {
+			notification := Notification{TaskN: task.MTask.N, Attempt: task.Attempt, Address: currentAddress, TempDir: tempDir, Skipped: task.MTask.Skipped, Counters: counters}
+			if err := callRetry(masterAddress, "Server.NotifyMapFinished", &notification, &junk, patience); err != nil {
 				log.Fatalf("Failed to NotifyMapFinished: %v", err)
 			}
 		} else if task.GotATask {
 			previouslySlept = false
-			fmt.Printf("ReduceTask %d Recieved.\nProcessing... \n", task.RTask.N)
-			time.Sleep(time.Duration(10000*task.RTask.N))
-			task.RTask.Process(tempDir, client)
+			fmt.Printf("ReduceTask %d (attempt %d) Recieved.\nProcessing... \n", task.RTask.N, task.Attempt)
+			time.Sleep(time.Duration(10000 * task.RTask.N))
+			resetCounters()
+			ctx := running.start(Status{Address: currentAddress, TaskN: task.RTask.N, Attempt: task.Attempt})
+			err := task.RTask.Process(tempDir, client, newTaskContext(ctx, task.Params, fmt.Sprintf("reduce %d", task.RTask.N), task.Attempt))
+			running.stop()
+
+			// a map output went missing: tell the master so it re-runs the map
+			var fetchErr *FetchError
+			if errors.As(err, &fetchErr) {
+				fmt.Printf("Could not fetch Maptask %d output.\n\n", fetchErr.Index)
+				failure := FetchFailure{TaskN: task.RTask.N, Attempt: task.Attempt, Address: currentAddress,
+					Map: fetchErr.Index, Host: task.RTask.SourceHosts[fetchErr.Index]}
+				if err := callRetry(masterAddress, "Server.NotifyFetchFailed", &failure, &junk, patience); err != nil {
+					log.Fatalf("Failed to NotifyFetchFailed: %v", err)
+				}
+				continue
+			} else if errors.Is(err, context.Canceled) {
+				fmt.Printf("Cancelled.\n\n")
+				continue
+			} else if err != nil {
+				reportFailure(masterAddress, patience, err, &TaskFailure{TaskN: task.RTask.N, Attempt: task.Attempt, Address: currentAddress})
+				continue
+			}
+			counters := takeCounters()
+			counters.print()
 			fmt.Printf("Finished.\n\n")
 
-			notification := Notification{TaskN: task.RTask.N, Address: currentAddress, Port: port}
-			if err := call(masterAddress, "Server.NotifyReduceFinished", &notification, &junk); err != nil {
+			notification := Notification{TaskN: task.RTask.N, Attempt: task.Attempt, Address: currentAddress, TempDir: tempDir, Skipped: task.RTask.Skipped, Counters: counters}
+			if err := callRetry(masterAddress, "Server.NotifyReduceFinished", &notification, &junk, patience); err != nil {
 				log.Fatalf("Failed to NotifyMapFinished: %v", err)
 			}
 
@@ -197,7 +377,7 @@ func runWorker(port, masterAddress, tempDir string, client Interface) error {
 		}
 
 		// Check to see if it is okay to shut down
-		if err := call(masterAddress, "Server.ShutdownRequest", &junk, &shutdown); err != nil {
+		if err := callRetry(masterAddress, "Server.ShutdownRequest", &self, &shutdown, patience); err != nil {
 			log.Fatalf("Failed to request shutdown: %v", err)
 		}
 	}
@@ -205,3 +385,40 @@ func runWorker(port, masterAddress, tempDir string, client Interface) error {
 	fmt.Printf("Shutting down...\n")
 	return nil
 }
+
+// sends a heartbeat every interval until stop is closed, cancelling the
+// running attempt if the master says so
+func heartbeat(masterAddress string, running *runningTask, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			status := running.current()
+			var reply HeartbeatReply
+			if err := call(masterAddress, "Server.Heartbeat", &status, &reply); err != nil {
+				log.Printf("Failed to send heartbeat: %v", err)
+			} else if reply.Cancel {
+				running.cancelIf(status)
+			}
+		}
+	}
+}
+
+// tells the master a task attempt failed instead of reporting it finished,
+// blaming the record the client's Map or Reduce failed on if there was one
+// (the keys Combine and Partition see are not records that can be skipped)
+func reportFailure(masterAddress string, patience time.Duration, err error, failure *TaskFailure) {
+	fmt.Printf("Failed: %v\n\n", err)
+	failure.Err = err.Error()
+	var userErr *UserError
+	if errors.As(err, &userErr) && (userErr.Func == "Map" || userErr.Func == "Reduce") {
+		failure.Key = userErr.Key
+	}
+	var junk Nothing
+	if err := callRetry(masterAddress, "Server.NotifyTaskFailed", failure, &junk, patience); err != nil {
+		log.Fatalf("Failed to NotifyTaskFailed: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package mapreduce
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"runtime/debug"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Comparator orders two keys like strings.Compare: negative if a sorts
+// before b, zero if they are equal, positive if a sorts after b
+type Comparator func(a, b string) int
+
+// KeyOrder can be implemented alongside Interface to change the order in
+// which a reduce task sees its keys (text order by default)
+type KeyOrder interface {
+	KeyOrder() Comparator
+}
+
+// Grouper can be implemented alongside Interface for a secondary sort. Map
+// emits composite keys, GroupKey extracts the part Reduce groups on, and the
+// whole key orders the values within a group, so Reduce gets its values
+// pre-sorted. [ex. Map emits "sensor7|2024-05-01T10:00:00", GroupKey returns
+// "sensor7", and Reduce("sensor7", ...) gets that sensor's readings in time
+// order]. Keys with the same group key must sort next to each other. Unless
+// the client brings its own Partitioner, keys are hashed on their group key
+// so a group stays in one reduce task. A Grouper can't be used in sort mode,
+// which range partitions on the whole key.
+type Grouper interface {
+	GroupKey(key string) string
+}
+
+// TextOrder is the default: byte-wise, like sqlite's BINARY collation
+var TextOrder Comparator = strings.Compare
+
+// NumericOrder sorts keys that are numbers by value ("9" before "10"), and
+// after them keys that aren't numbers, in text order
+func NumericOrder(a, b string) int {
+	x, xok := new(big.Float).SetString(strings.TrimSpace(a))
+	y, yok := new(big.Float).SetString(strings.TrimSpace(b))
+	switch {
+	case xok && yok:
+		if c := x.Cmp(y); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case xok:
+		return -1
+	case yok:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Reverse sorts keys the opposite way to c
+func Reverse(c Comparator) Comparator {
+	return func(a, b string) int { return c(b, a) }
+}
+
+// the key order client asked for, or nil for text order
+func clientKeyOrder(client ContextInterface) Comparator {
+	if k, ok := clientImpl(client).(KeyOrder); ok {
+		return k.KeyOrder()
+	}
+	return nil
+}
+
+// the group key of key, which is the key itself without a Grouper; a panic
+// in GroupKey comes back as a *UserError
+func groupKey(client ContextInterface, key string) (group string, err error) {
+	g, ok := clientImpl(client).(Grouper)
+	if !ok {
+		return key, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &UserError{Func: "GroupKey", Key: key, Err: fmt.Errorf("%v", r), Stack: string(debug.Stack())}
+		}
+	}()
+	return g.GroupKey(key), nil
+}
+
+// name of the collation a reduce task registers for the client's key order
+const keyCollation = "mapreduce_keys"
+
+// orderedRows are the pairs of a reduce input in the order Reduce sees them
+type orderedRows struct {
+	*sql.Rows
+	conn     *sql.Conn // the connection the key order is registered on
+	panicked error     // the client's comparator panicked while sorting
+}
+
+// queries all pairs in db ordered by key, then value, using order to
+// compare keys if it isn't nil. The comparator is registered as a collation
+// on a connection of its own, which Close releases. Collations only apply to
+// text, so a ByteInterface client's blob keys are cast for it (the bytes are
+// kept as they are).
+func queryOrdered(db *sql.DB, order Comparator) (*orderedRows, error) {
+	if order == nil {
+		rows, err := db.Query(`SELECT key, value FROM pairs ORDER BY key, value`)
+		if err != nil {
+			return nil, err
+		}
+		return &orderedRows{Rows: rows}, nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &orderedRows{conn: conn}
+
+	// a panic must not unwind through sqlite, so it is kept for Err
+	// and the keys it was comparing are taken as equal
+	collate := func(a, b string) (n int) {
+		defer func() {
+			if rec := recover(); rec != nil && r.panicked == nil {
+				r.panicked = &UserError{Func: "KeyOrder", Key: a, Err: fmt.Errorf("%v", rec), Stack: string(debug.Stack())}
+			}
+		}()
+		return order(a, b)
+	}
+	err = conn.Raw(func(driverConn interface{}) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return sqliteConn.RegisterCollation(keyCollation, collate)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error registering key order: %v", err)
+	}
+	if r.Rows, err = conn.QueryContext(ctx, `SELECT key, value FROM pairs ORDER BY CAST(key AS TEXT) COLLATE `+keyCollation+`, value`); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *orderedRows) Err() error {
+	if r.panicked != nil {
+		return r.panicked
+	}
+	return r.Rows.Err()
+}
+
+func (r *orderedRows) Close() error {
+	err := r.Rows.Close()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package mapreduce
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Partitioner decides which reduce task gets each key a map task emits. It
+// must return a number in [0, reduceTasks) and give the same answer for the
+// same key on every worker.
+type Partitioner interface {
+	Partition(key string, reduceTasks int) int
+}
+
+// Partitioned can be implemented alongside Interface to route keys with
+// something other than the default HashPartitioner
+type Partitioned interface {
+	Partitioner() Partitioner
+}
+
+// HashPartitioner spreads keys evenly by their FNV hash; it is the default
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key string, reduceTasks int) int {
+	hash := fnv.New32()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(reduceTasks))
+}
+
+func (HashPartitioner) String() string { return "hash" }
+
+// PrefixPartitioner hashes only the part of the key before the first Sep, so
+// keys sharing that prefix land in the same reduce task
+// [ex. Sep ":" sends "austen:emma" and "austen:persuasion" together]
+type PrefixPartitioner struct {
+	Sep string
+}
+
+func (p PrefixPartitioner) Partition(key string, reduceTasks int) int {
+	if i := strings.Index(key, p.Sep); i >= 0 && p.Sep != "" {
+		key = key[:i]
+	}
+	return HashPartitioner{}.Partition(key, reduceTasks)
+}
+
+func (p PrefixPartitioner) String() string { return fmt.Sprintf("prefix(%q)", p.Sep) }
+
+// RangePartitioner sends keys to reduce tasks by range, so that every key in
+// reduce task i sorts before every key in reduce task i+1. Splits holds the
+// reduceTasks-1 sorted boundaries: reduce task i gets the keys k with
+// Splits[i-1] <= k < Splits[i]. Keys past the last boundary go to the last
+// reduce task. Compare orders keys (text order if nil).
+type RangePartitioner struct {
+	Splits  []string
+	Compare Comparator
+}
+
+func (p RangePartitioner) Partition(key string, reduceTasks int) int {
+	compare := p.Compare
+	if compare == nil {
+		compare = TextOrder
+	}
+	r := sort.Search(len(p.Splits), func(i int) bool { return compare(key, p.Splits[i]) < 0 })
+	if r >= reduceTasks {
+		r = reduceTasks - 1
+	}
+	return r
+}
+
+func (p RangePartitioner) String() string { return fmt.Sprintf("range(%d splits)", len(p.Splits)) }
+
+// how many keys the master samples from the input to pick split points for
+// a total-order sort
+const sortSamples = 10000
+
+// samples keys from the m map source splits in dir and picks the r-1 split
+// points that cut the sample into r ranges of about the same size in order
+// (text order if nil). Keys are sampled from the input, so this assumes Map
+// keeps keys as they are (or at least in the same order), as sorting jobs do.
+func sampleSplits(dir string, m, r int, order Comparator) ([]string, error) {
+	var sample []string
+	for i := 0; i < m; i++ {
+		db, err := openDatabase(dir + mapSourceFile(i))
+		if err != nil {
+			return nil, err
+		}
+		rows, err := db.Query("SELECT key FROM pairs ORDER BY random() LIMIT ?", sortSamples/m+1)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error sampling %s: %v", mapSourceFile(i), err)
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				db.Close()
+				return nil, fmt.Errorf("error sampling %s: %v", mapSourceFile(i), err)
+			}
+			sample = append(sample, key)
+		}
+		err = rows.Err()
+		rows.Close()
+		db.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error sampling %s: %v", mapSourceFile(i), err)
+		}
+	}
+	if len(sample) == 0 {
+		return nil, nil
+	}
+
+	if order == nil {
+		order = TextOrder
+	}
+	sort.SliceStable(sample, func(i, j int) bool { return order(sample[i], sample[j]) < 0 })
+	splits := make([]string, r-1)
+	for i := range splits {
+		splits[i] = sample[(i+1)*len(sample)/r]
+	}
+	return splits, nil
+}
+
+// PartitionFunc turns an ordinary function into a Partitioner, for joins and
+// other jobs that need an explicit mapping
+type PartitionFunc func(key string, reduceTasks int) int
+
+func (f PartitionFunc) Partition(key string, reduceTasks int) int { return f(key, reduceTasks) }
+
+func (f PartitionFunc) String() string { return "func" }
+
+// groupPartitioner hashes the group key of a Grouper client, so all the
+// keys of a group go to the same reduce task
+type groupPartitioner struct {
+	grouper Grouper
+}
+
+func (p groupPartitioner) Partition(key string, reduceTasks int) int {
+	return HashPartitioner{}.Partition(p.grouper.GroupKey(key), reduceTasks)
+}
+
+func (groupPartitioner) String() string { return "hash(group key)" }
+
+// the partitioner client asked for, or the default
+func clientPartitioner(client ContextInterface) Partitioner {
+	if p, ok := clientImpl(client).(Partitioned); ok {
+		if partitioner := p.Partitioner(); partitioner != nil {
+			return partitioner
+		}
+	}
+	if g, ok := clientImpl(client).(Grouper); ok {
+		return groupPartitioner{grouper: g}
+	}
+	return HashPartitioner{}
+}
+
+// how a partitioner is named in the job's metadata
+func partitionerName(p Partitioner) string {
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+// routes key to a reduce task, turning a panic or a partition out of range
+// into a *UserError
+func partition(p Partitioner, key string, reduceTasks int) (r int, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = &UserError{Func: "Partition", Key: key, Err: fmt.Errorf("%v", rec), Stack: string(debug.Stack())}
+		}
+	}()
+	r = p.Partition(key, reduceTasks)
+	if r < 0 || r >= reduceTasks {
+		return 0, &UserError{Func: "Partition", Key: key, Err: fmt.Errorf("%s partitioner picked reduce task %d of %d", partitionerName(p), r, reduceTasks)}
+	}
+	return r, nil
+}
@@ -0,0 +1,309 @@
+package mapreduce
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// input formats read record by record
+const (
+	JSONLInput = "jsonl" // one JSON object per line (.gz and .zst files are decompressed)
+	CSVInput   = "csv"   // comma-separated values, with a header row unless Fields.NoHeader
+)
+
+// Fields says how the records of jsonl and csv inputs become pairs
+type Fields struct {
+	// field (csv column) that becomes the key; records are keyed
+	// "file:offset" if it's empty
+	Key string `json:"key"`
+	// fields that become the value: a single field as it is, several as a
+	// JSON object of them, and the whole record as a JSON object if empty
+	Value []string `json:"value"`
+	// csv files have no header row; their columns are named "0", "1", ...
+	NoHeader bool `json:"no_header"`
+}
+
+// a record of the input as the fields it has, in order, as raw JSON
+type record struct {
+	names  []string
+	values []json.RawMessage
+}
+
+func (r *record) field(name string) (json.RawMessage, bool) {
+	for i, n := range r.names {
+		if n == name {
+			return r.values[i], true
+		}
+	}
+	return nil, false
+}
+
+// the pair fields makes of the record found at at [ex. "logs.jsonl:1024"]
+func (f *Fields) pair(at string, r *record) (key, value []byte, err error) {
+	key = []byte(at)
+	if f.Key != "" {
+		raw, ok := r.field(f.Key)
+		if !ok {
+			return nil, nil, fmt.Errorf("no key field %q", f.Key)
+		}
+		key = fieldText(raw)
+	}
+
+	switch len(f.Value) {
+	case 0:
+		return key, jsonObject(r.names, r.values), nil
+	case 1:
+		raw, ok := r.field(f.Value[0])
+		if !ok {
+			return nil, nil, fmt.Errorf("no value field %q", f.Value[0])
+		}
+		return key, fieldText(raw), nil
+	}
+	values := make([]json.RawMessage, len(f.Value))
+	for i, name := range f.Value {
+		raw, ok := r.field(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("no value field %q", name)
+		}
+		values[i] = raw
+	}
+	return key, jsonObject(f.Value, values), nil
+}
+
+// a field on its own: a JSON string without its quotes, anything else as
+// the JSON it is
+func fieldText(raw json.RawMessage) []byte {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []byte(s)
+	}
+	return raw
+}
+
+// a JSON object of the fields, keeping their order
+func jsonObject(names []string, values []json.RawMessage) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		quoted, _ := json.Marshal(name)
+		buf.Write(quoted)
+		buf.WriteByte(':')
+		buf.Write(values[i])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// badRecords counts the records that could not be read, logging the first
+// few of them
+type badRecords struct {
+	n int
+}
+
+const badRecordsLogged = 10
+
+func (b *badRecords) add(at string, err error) {
+	b.n += 1
+	if b.n <= badRecordsLogged {
+		log.Printf("skipping bad input record at %s: %v", at, err)
+	} else if b.n == badRecordsLogged+1 {
+		log.Printf("skipping more bad input records without logging them")
+	}
+}
+
+// reads the JSON objects of a jsonl file, one per line; blank lines are
+// ignored
+func readJSONL(path string, fields *Fields, emit func(key, value []byte) error, bad *badRecords) error {
+	return readLines(fileSplit{path: path, end: math.MaxInt64}, func(offset int64, line []byte) error {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+		at := fmt.Sprintf("%s:%d", path, offset)
+		r, err := parseJSONObject(line)
+		if err != nil {
+			bad.add(at, err)
+			return nil
+		}
+		key, value, err := fields.pair(at, r)
+		if err != nil {
+			bad.add(at, err)
+			return nil
+		}
+		return emit(key, value)
+	})
+}
+
+// parses a JSON object, keeping its fields in the order they are written
+func parseJSONObject(data []byte) (*record, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("record is not a JSON object")
+	}
+	r := &record{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var value bytes.Buffer
+		json.Compact(&value, raw)
+		r.names = append(r.names, tok.(string))
+		r.values = append(r.values, value.Bytes())
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("data after the JSON object")
+	}
+	return r, nil
+}
+
+// reads the rows of a csv file; a row with the wrong number of columns or
+// broken quoting is a bad record, a missing column in the header is an
+// error
+func readCSV(path string, fields *Fields, emit func(key, value []byte) error, bad *badRecords) error {
+	f, closeFile, err := openSplit(fileSplit{path: path, end: math.MaxInt64}, 0)
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+	r := csv.NewReader(f)
+
+	var names []string
+	if !fields.NoHeader {
+		if names, err = r.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading header: %v", err)
+		}
+		for _, name := range append([]string{fields.Key}, fields.Value...) {
+			if name != "" && !slices.Contains(names, name) {
+				return fmt.Errorf("no column %q in the header", name)
+			}
+		}
+	}
+
+	for {
+		at := fmt.Sprintf("%s:%d", path, r.InputOffset())
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			bad.add(at, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		rec := &record{names: names}
+		if fields.NoHeader {
+			rec.names = nil
+			for i := range row {
+				rec.names = append(rec.names, strconv.Itoa(i))
+			}
+		}
+		for _, value := range row {
+			quoted, _ := json.Marshal(value)
+			rec.values = append(rec.values, quoted)
+		}
+		key, value, err := fields.pair(at, rec)
+		if err != nil {
+			bad.add(at, err)
+			continue
+		}
+		if err := emit(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// splitRecords deals the records of jsonl or csv inputs round-robin into the
+// outputs for the map tasks. Records that can't be read are counted under
+// InputParseErrors and left out.
+func splitRecords(format string, fields *Fields, inputs []string, outputs []string) (Counters, error) {
+	m := len(outputs)
+	files, err := expandInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	read := readJSONL
+	if format == CSVInput {
+		read = readCSV
+	}
+
+	// every output gets written in one transaction
+	var dbs []*sql.DB
+	var txs []*sql.Tx
+	var stmts []*sql.Stmt
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	for _, outputName := range outputs {
+		db, err := createDatabase(outputName)
+		if err != nil {
+			return nil, fmt.Errorf("error creating map input %s: %v", outputName, err)
+		}
+		dbs = append(dbs, db)
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+		stmt, err := tx.Prepare("insert into pairs (key, value) values (?, ?)")
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	records := 0
+	emit := func(key, value []byte) error {
+		_, err := stmts[records%m].Exec(key, value)
+		records++
+		return err
+	}
+	var bad badRecords
+	for _, file := range files {
+		if err := read(file, fields, emit, &bad); err != nil {
+			return nil, fmt.Errorf("error splitting %s: %v", file, err)
+		}
+	}
+	for _, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Split %d records from %d files into %d map tasks (%d bad records skipped)\n", records, len(files), m, bad.n)
+	return Counters{InputParseErrors: int64(bad.n)}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"time"
 )
 
 // runs the server with an actor
@@ -35,11 +36,32 @@ func startActor(tasks *Tasks) Server {
 	go func() {
 		for f := range ch {
 			f(tasks)
+
+			// keep the journal up to date, and drop it once the job is over
+			if j := tasks.journal; j != nil && tasks.Finished {
+				j.remove()
+				tasks.journal = nil
+			} else if j != nil {
+				j.save(tasks)
+			}
 		}
 	}()
 	return ch
 }
 
+// periodically asks the actor to requeue tasks whose lease expired or
+// whose worker stopped sending heartbeats
+func (s Server) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s <- func(t *Tasks) {
+			if !t.Finished {
+				t.requeueExpired()
+				t.checkWorkers()
+			}
+		}
+	}
+}
+
 func call(address string, method string, request interface{}, response interface{}) error {
 	client, err := rpc.DialHTTP("tcp", address)
 	if err != nil {
@@ -56,13 +78,38 @@ func call(address string, method string, request interface{}, response interface
 	return nil
 }
 
+// like call, but keeps retrying for up to patience so a worker can ride out
+// a master restart
+func callRetry(address string, method string, request interface{}, response interface{}, patience time.Duration) error {
+	deadline := time.Now().Add(patience)
+	for {
+		err := call(address, method, request, response)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 // Notifies the master of it's existence
-func (s Server) Ping(junk *Nothing, rubbish *Nothing) error {
+func (s Server) Ping(worker *Notification, rubbish *Nothing) error {
 	finished := make(chan struct{})
 	s <- func(t *Tasks) {
-		fmt.Printf("Pinged by new Worker!\n")
-		// adds to a count of workers
-		t.AliveWorkers += 1
+		// adds it to the worker registry
+		t.seen(worker.Address)
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Lets the master know the worker is still alive, renewing the lease of the
+// attempt it is running; the reply calls off the attempt if it lost its lease
+func (s Server) Heartbeat(status *Status, reply *HeartbeatReply) error {
+	finished := make(chan struct{})
+	s <- func(t *Tasks) {
+		t.seen(status.Address)
+		reply.Cancel = status.Busy && (t.Finished || !t.renew(status.IsMap, status.TaskN, status.Attempt))
 		finished <- struct{}{}
 	}
 	<-finished
@@ -70,17 +117,19 @@ func (s Server) Ping(junk *Nothing, rubbish *Nothing) error {
 }
 
 // Looks for a task that hasn't been distributed yet (DISTRIBUTED != FINISHED)
-func (s Server) GetTask(junk *Nothing, task *Task) error {
+func (s Server) GetTask(worker *Notification, task *Task) error {
 	finished := make(chan struct{})
 	s <- func(t *Tasks) {
+		t.seen(worker.Address)
+		if t.Finished {
+			finished <- struct{}{}
+			return
+		}
 
 		// Is a MapTask still available?
 		for r, mT := range t.MTasks {
-			if !mT.Distributed {
-				t.MTasks[r].Distributed = true
-				task.MTask = t.MTasks[r]
-				task.GotATask = true
-				task.IsMap = true
+			if !mT.Distributed && !mT.Finished {
+				t.leaseMap(r, worker.Address, false, task)
 				break
 			}
 		}
@@ -97,28 +146,34 @@ func (s Server) GetTask(junk *Nothing, task *Task) error {
 		// Is there any Reduce Tasks available?
 		if mapsFinished && !task.GotATask {
 			for r, rT := range t.RTasks {
-				if !rT.Distributed {
-					t.RTasks[r].Distributed = true
-					task.RTask = t.RTasks[r]
-					task.GotATask = true
+				if !rT.Distributed && !rT.Finished {
+					t.leaseReduce(r, worker.Address, false, task)
 					break
 				}
 			}
 		}
+
+		// nothing left to hand out: maybe back up a straggler
+		if !task.GotATask {
+			t.leaseBackup(worker.Address, mapsFinished, task)
+		}
+		task.Params = t.Params
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func (s Server) ShutdownRequest(junk *Nothing, shutdown *Shutdown) error {
+func (s Server) ShutdownRequest(worker *Notification, shutdown *Shutdown) error {
 	finished := make(chan struct{})
 	s <- func(t *Tasks) {
 
-		// if program finished, shutdown is okay
+		// if program finished, shutdown is okay and the worker leaves the registry
 		shutdown.Ok = t.Finished
 		if t.Finished {
-			t.AliveWorkers -= 1
+			delete(t.Workers, worker.Address)
+		} else {
+			t.seen(worker.Address)
 		}
 
 		finished <- struct{}{}
@@ -132,12 +187,37 @@ func (s Server) NotifyMapFinished(notification *Notification, junk *Nothing) err
 	finished := make(chan struct{})
 	s <- func(t *Tasks) {
 
+		// ignore attempts that already lost their lease or lost the race
+		mT := &t.MTasks[notification.TaskN]
+		lease := findLease(mT.Leases, notification.Attempt)
+		if mT.Finished || lease < 0 {
+			fmt.Printf("Ignoring stale Maptask %d attempt %d from %s\n", notification.TaskN, notification.Attempt, notification.Address)
+			t.release(notification.Address, false)
+			finished <- struct{}{}
+			return
+		}
+
 		// set the task to finished and update the reduce sources
 		fmt.Printf("Maptask %d finished by %s\n", notification.TaskN, notification.Address)
-		t.MTasks[notification.TaskN].Finished = true
+		mT.Finished = true
+		mT.Runtime = t.commit(mT.Leases[lease])
+		mT.FinishedBy = notification.Address
+		mT.FinishedByDir = notification.TempDir
+		mT.Skipped = notification.Skipped
+		mT.Counters = notification.Counters
+		for _, l := range mT.Leases {
+			t.unassign(true, notification.TaskN, l) // the attempts that lost the race
+		}
+		mT.Leases = nil
+		t.release(notification.Address, true)
 		for _, task := range t.RTasks {
 			task.SourceHosts[notification.TaskN] = notification.Address
-			task.SourcePorts[notification.TaskN] = notification.Port
+			task.SourceDirs[notification.TaskN] = notification.TempDir
+		}
+
+		// a map-only job has no reduce phase to wait for
+		if len(t.RTasks) == 0 {
+			t.checkDone()
 		}
 
 		finished <- struct{}{}
@@ -146,40 +226,134 @@ func (s Server) NotifyMapFinished(notification *Notification, junk *Nothing) err
 	return nil
 }
 
-// Let the Master know that a Reduce Task has been completed
-func (s Server) NotifyReduceFinished(notification *Notification, junk *Nothing) error {
+// Let the Master know that a Reduce Task could not download a map output,
+// so the map gets re-executed and the reduce retried once it's back
+func (s Server) NotifyFetchFailed(failure *FetchFailure, junk *Nothing) error {
 	finished := make(chan struct{})
 	s <- func(t *Tasks) {
+		fmt.Printf("Reducetask %d attempt %d on %s could not fetch Maptask %d output from %s\n",
+			failure.TaskN, failure.Attempt, failure.Address, failure.Map, failure.Host)
 
-		// sets the task to finished and records what worker finished it (address and port)
-		fmt.Printf("Reducetask %d finished by %s\n", notification.TaskN, notification.Address)
-		t.RTasks[notification.TaskN].Finished = true
-		t.RTasks[notification.TaskN].FinishedBy = notification.Address
-		t.RTasks[notification.TaskN].FinishedByPort = notification.Port
+		// only the first report about this copy of the output counts against the
+		// map and re-executes it, along with every other output stored on the
+		// same unreachable host
+		if mT := t.MTasks[failure.Map]; mT.Finished && mT.FinishedBy == failure.Host {
+			t.countUnreachable(true, failure.Map, failure.Host)
+			for m := range t.MTasks {
+				if t.MTasks[m].Finished && t.MTasks[m].FinishedBy == failure.Host {
+					t.reopenMap(m, "is unreachable")
+				}
+			}
+		}
 
-		// Check to see if all ReduceTasks are finished
-		allFinished := true
-		for _, task := range t.RTasks {
-			if !task.Finished {
-				allFinished = false
+		// this attempt is done for; the reduce goes back to pending
+		rT := &t.RTasks[failure.TaskN]
+		if i := findLease(rT.Leases, failure.Attempt); i >= 0 {
+			rT.Leases = append(rT.Leases[:i], rT.Leases[i+1:]...)
+			if len(rT.Leases) == 0 && !rT.Finished {
+				rT.Distributed = false
 			}
 		}
+		t.release(failure.Address, false)
 
-		// IF they're all finished, we can merge the Reduce Outputs into our final output file
-		if allFinished {
-			var databaseUrls []string
-			for i, task := range t.RTasks {
-				databaseUrls = append(databaseUrls, makeURL(task.FinishedBy, task.FinishedByPort, reduceOutputFile(i)))
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Let the Master know that a task attempt failed; the task is retried until
+// it has failed MaxFailures times, then the whole job fails
+func (s Server) NotifyTaskFailed(failure *TaskFailure, junk *Nothing) error {
+	finished := make(chan struct{})
+	s <- func(t *Tasks) {
+		kind := "Reducetask"
+		if failure.IsMap {
+			kind = "Maptask"
+		}
+		fmt.Printf("%s %d attempt %d failed on %s: %s\n", kind, failure.TaskN, failure.Attempt, failure.Address, failure.Err)
+		t.release(failure.Address, false)
+
+		// drop the failed attempt, ignoring attempts that were already stale
+		var leases *[]Lease
+		var distributed *bool
+		var failures *int
+		var badRecords *map[string]int
+		var skip *[]string
+		if failure.IsMap {
+			mT := &t.MTasks[failure.TaskN]
+			leases, distributed, failures = &mT.Leases, &mT.Distributed, &mT.Failures
+			badRecords, skip = &mT.BadRecords, &mT.Skip
+		} else {
+			rT := &t.RTasks[failure.TaskN]
+			leases, distributed, failures = &rT.Leases, &rT.Distributed, &rT.Failures
+			badRecords, skip = &rT.BadRecords, &rT.Skip
+		}
+		i := findLease(*leases, failure.Attempt)
+		if t.Finished || i < 0 {
+			finished <- struct{}{}
+			return
+		}
+		*leases = append((*leases)[:i], (*leases)[i+1:]...)
+		*distributed = len(*leases) > 0
+
+		// when skipping is on, a failure blamed on a record also counts against
+		// the record; after SkipAfter of them it gets skipped. It still counts
+		// against the task too, so a task failing on every record fails the job
+		// instead of quarantining its whole input.
+		if t.SkipAfter > 0 && failure.Key != "" {
+			if *badRecords == nil {
+				*badRecords = make(map[string]int)
+			}
+			(*badRecords)[failure.Key] += 1
+			if (*badRecords)[failure.Key] == t.SkipAfter {
+				fmt.Printf("%s %d will skip record %q from now on\n", kind, failure.TaskN, failure.Key)
+				*skip = append(*skip, failure.Key)
 			}
-			mergeDatabases(databaseUrls, "finalOutput.db", makeTempDir(t.MTasks[0].SourcePort)+"finalOutputTemp.db")
-			fmt.Printf("finalOutput.db Created!\n")
-			
-			// t.Finished is for workers when they RPC ShutdownOk
-			t.Finished = true
-			// t.FinChannel is for the master to know that Merge is complete, it just has to wait for workers to shut down
-			*t.FinChannel <- *junk
 		}
 
+		// retry, or give up on the job
+		*failures += 1
+		if *failures >= t.MaxFailures {
+			t.finish(fmt.Errorf("%s %d failed %d times, last on %s: %s", kind, failure.TaskN, *failures, failure.Address, failure.Err))
+		}
+
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Let the Master know that a Reduce Task has been completed
+func (s Server) NotifyReduceFinished(notification *Notification, junk *Nothing) error {
+	finished := make(chan struct{})
+	s <- func(t *Tasks) {
+
+		// ignore attempts that already lost their lease or lost the race
+		rT := &t.RTasks[notification.TaskN]
+		lease := findLease(rT.Leases, notification.Attempt)
+		if rT.Finished || lease < 0 {
+			fmt.Printf("Ignoring stale Reducetask %d attempt %d from %s\n", notification.TaskN, notification.Attempt, notification.Address)
+			t.release(notification.Address, false)
+			finished <- struct{}{}
+			return
+		}
+
+		// sets the task to finished and records what worker finished it (address and temp directory)
+		fmt.Printf("Reducetask %d finished by %s\n", notification.TaskN, notification.Address)
+		rT.Finished = true
+		rT.Runtime = t.commit(rT.Leases[lease])
+		for _, l := range rT.Leases {
+			t.unassign(false, notification.TaskN, l) // the attempts that lost the race
+		}
+		rT.Leases = nil
+		t.release(notification.Address, true)
+		t.RTasks[notification.TaskN].FinishedBy = notification.Address
+		t.RTasks[notification.TaskN].FinishedByDir = notification.TempDir
+		t.RTasks[notification.TaskN].Skipped = notification.Skipped
+		t.RTasks[notification.TaskN].Counters = notification.Counters
+		t.checkDone()
+
 		finished <- struct{}{}
 	}
 	<-finished
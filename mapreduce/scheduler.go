@@ -0,0 +1,463 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Lease is one attempt at running a task. The task stays Distributed while
+// it holds a live lease. Every heartbeat from the worker pushes the deadline
+// out, so a slow attempt keeps its lease; once the deadline passes the
+// worker has stopped sending them, the attempt is presumed lost and the task
+// goes back to pending.
+type Lease struct {
+	Attempt  int
+	Worker   string // address of the worker running the attempt
+	Started  time.Time
+	Deadline time.Time `json:"-"` // renewed too often to journal
+	Backup   bool      // speculative copy of an attempt that is taking too long
+}
+
+// grants the next attempt of a task to worker, counting it in attempts
+func newLease(attempts *int, worker string, timeout time.Duration) Lease {
+	*attempts += 1
+	now := time.Now()
+	return Lease{Attempt: *attempts, Worker: worker, Started: now, Deadline: now.Add(timeout)}
+}
+
+// index of the live lease for attempt, or -1 if it has none (stale attempt)
+func findLease(leases []Lease, attempt int) int {
+	for i, l := range leases {
+		if l.Attempt == attempt {
+			return i
+		}
+	}
+	return -1
+}
+
+// hands out the next attempt of map task n to worker
+func (t *Tasks) leaseMap(n int, worker string, backup bool, task *Task) {
+	mT := &t.MTasks[n]
+	lease := newLease(&mT.Attempts, worker, t.LeaseTimeout)
+	lease.Backup = backup
+	mT.Leases = append(mT.Leases, lease)
+	mT.Distributed = true
+
+	task.MTask = *mT
+	task.MTask.Leases = nil
+	task.Attempt = lease.Attempt
+	task.GotATask = true
+	task.IsMap = true
+	t.assign(worker, attemptName(true, n, lease.Attempt))
+}
+
+// hands out the next attempt of reduce task n to worker
+func (t *Tasks) leaseReduce(n int, worker string, backup bool, task *Task) {
+	rT := &t.RTasks[n]
+	lease := newLease(&rT.Attempts, worker, t.LeaseTimeout)
+	lease.Backup = backup
+	rT.Leases = append(rT.Leases, lease)
+	rT.Distributed = true
+
+	task.RTask = *rT
+	task.RTask.Leases = nil
+	task.Attempt = lease.Attempt
+	task.GotATask = true
+	t.assign(worker, attemptName(false, n, lease.Attempt))
+}
+
+// drops every lease matching revoke and puts tasks left without a live
+// lease back up for grabs
+func (t *Tasks) revokeLeases(reason string, revoke func(Lease) bool) {
+	for i := range t.MTasks {
+		mT := &t.MTasks[i]
+		mT.Leases = dropLeases(mT.Leases, revoke, func(l Lease) {
+			fmt.Printf("Maptask %d attempt %d on %s %s\n", i, l.Attempt, l.Worker, reason)
+			t.unassign(true, i, l)
+		})
+		if len(mT.Leases) == 0 && mT.Distributed && !mT.Finished {
+			fmt.Printf("Requeueing Maptask %d\n", i)
+			mT.Distributed = false
+		}
+	}
+	for i := range t.RTasks {
+		rT := &t.RTasks[i]
+		rT.Leases = dropLeases(rT.Leases, revoke, func(l Lease) {
+			fmt.Printf("Reducetask %d attempt %d on %s %s\n", i, l.Attempt, l.Worker, reason)
+			t.unassign(false, i, l)
+		})
+		if len(rT.Leases) == 0 && rT.Distributed && !rT.Finished {
+			fmt.Printf("Requeueing Reducetask %d\n", i)
+			rT.Distributed = false
+		}
+	}
+}
+
+// keeps the leases not matching revoke, calling dropped on the others
+func dropLeases(leases []Lease, revoke func(Lease) bool, dropped func(Lease)) []Lease {
+	var live []Lease
+	for _, l := range leases {
+		if revoke(l) {
+			dropped(l)
+		} else {
+			live = append(live, l)
+		}
+	}
+	return live
+}
+
+// pushes the deadline of an attempt out to LeaseTimeout from now, since its
+// worker is still alive; reports false if the attempt lost its lease
+func (t *Tasks) renew(isMap bool, n, attempt int) bool {
+	var leases []Lease
+	if isMap && n < len(t.MTasks) {
+		leases = t.MTasks[n].Leases
+	} else if !isMap && n < len(t.RTasks) {
+		leases = t.RTasks[n].Leases
+	}
+	i := findLease(leases, attempt)
+	if i < 0 {
+		return false
+	}
+	leases[i].Deadline = time.Now().Add(t.LeaseTimeout)
+	return true
+}
+
+// requeues attempts that ran past their deadline. Heartbeats keep renewing
+// the lease of a slow attempt, so only an attempt whose worker went quiet
+// expires; like a dead worker, that doesn't count as a failure of the task.
+func (t *Tasks) requeueExpired() {
+	now := time.Now()
+	t.revokeLeases("lease expired", func(l Lease) bool { return now.After(l.Deadline) })
+}
+
+// WorkerInfo is what the master knows about one worker
+type WorkerInfo struct {
+	Address     string
+	LastSeen    time.Time
+	CurrentTask string // empty while idle
+	Completed   int    // tasks this worker finished that were accepted
+	Alive       bool
+}
+
+// records a sign of life from a worker, registering it if it is new
+func (t *Tasks) seen(address string) *WorkerInfo {
+	w, ok := t.Workers[address]
+	if !ok {
+		fmt.Printf("Registered worker %s\n", address)
+		w = &WorkerInfo{Address: address}
+		t.Workers[address] = w
+	} else if !w.Alive {
+		fmt.Printf("Worker %s is back\n", address)
+	}
+	w.LastSeen = time.Now()
+	w.Alive = true
+	return w
+}
+
+func (t *Tasks) assign(address, task string) {
+	t.seen(address).CurrentTask = task
+}
+
+// how the registry shows an attempt [ex. map 3 attempt 2]
+func attemptName(isMap bool, n, attempt int) string {
+	if isMap {
+		return fmt.Sprintf("map %d attempt %d", n, attempt)
+	}
+	return fmt.Sprintf("reduce %d attempt %d", n, attempt)
+}
+
+// marks the worker of a dropped lease idle, unless it has moved on to
+// another task since; the worker only finds out at its next heartbeat
+func (t *Tasks) unassign(isMap bool, n int, lease Lease) {
+	if w, ok := t.Workers[lease.Worker]; ok && w.CurrentTask == attemptName(isMap, n, lease.Attempt) {
+		w.CurrentTask = ""
+	}
+}
+
+// marks the worker idle again; accepted counts toward its completed tasks
+func (t *Tasks) release(address string, accepted bool) {
+	w := t.seen(address)
+	w.CurrentTask = ""
+	if accepted {
+		w.Completed += 1
+	}
+}
+
+// marks workers that missed their heartbeats as dead and reassigns
+// whatever they were running
+func (t *Tasks) checkWorkers() {
+	now := time.Now()
+	for addr, w := range t.Workers {
+		if w.Alive && now.Sub(w.LastSeen) > t.HeartbeatTimeout {
+			fmt.Printf("Worker %s missed its heartbeats (last seen %v ago), marking it dead\n", addr, now.Sub(w.LastSeen).Round(time.Second))
+			w.Alive = false
+			w.CurrentTask = ""
+			t.revokeLeases("lost with its worker", func(l Lease) bool { return l.Worker == addr })
+
+			// so are the outputs stored on it: reduce outputs wait there for
+			// the final merge, and the map outputs are needed again by the
+			// reduce tasks reopened here
+			for r := range t.RTasks {
+				if t.RTasks[r].Finished && t.RTasks[r].FinishedBy == addr {
+					t.reopenReduce(r, "died with its worker")
+				}
+			}
+			for m := range t.MTasks {
+				if t.MTasks[m].Finished && t.MTasks[m].FinishedBy == addr {
+					t.reopenMap(m, "died with its worker")
+				}
+			}
+			printWorkers(t)
+		}
+	}
+}
+
+// puts a finished map task back to pending because its output is gone,
+// unless no reduce task needs it anymore (in a map-only job the output is
+// needed until the job is done)
+func (t *Tasks) reopenMap(m int, reason string) {
+	needed := len(t.RTasks) == 0 && !t.Finished
+	for _, rT := range t.RTasks {
+		if !rT.Finished {
+			needed = true
+		}
+	}
+	if !needed {
+		return
+	}
+
+	mT := &t.MTasks[m]
+	fmt.Printf("Maptask %d output on %s %s, re-executing it\n", m, mT.FinishedBy, reason)
+	mT.Finished = false
+	mT.Distributed = len(mT.Leases) > 0
+	mT.FinishedBy = ""
+	mT.FinishedByDir = ""
+	mT.Counters = nil
+
+	// reducers get pointed at the new copy when the map finishes again
+	for r := range t.RTasks {
+		t.RTasks[r].SourceHosts[m] = ""
+		t.RTasks[r].SourceDirs[m] = ""
+	}
+}
+
+// puts a finished reduce task back to pending because its output is gone
+// before the final merge could fetch it
+func (t *Tasks) reopenReduce(r int, reason string) {
+	rT := &t.RTasks[r]
+	fmt.Printf("Reducetask %d output on %s %s, re-executing it\n", r, rT.FinishedBy, reason)
+	rT.Finished = false
+	rT.Distributed = len(rT.Leases) > 0
+	rT.FinishedBy = ""
+	rT.FinishedByDir = ""
+	rT.Counters = nil
+}
+
+// counts an output that could not be fetched from host against the task that
+// made it. A host that keeps answering heartbeats but can't serve its outputs
+// would otherwise have them re-executed forever, so once the task has failed
+// MaxFailures times the job fails.
+func (t *Tasks) countUnreachable(isMap bool, n int, host string) {
+	kind, failures := "Reducetask", &t.RTasks[n].Failures
+	if isMap {
+		kind, failures = "Maptask", &t.MTasks[n].Failures
+	}
+	*failures += 1
+	if *failures >= t.MaxFailures {
+		t.finish(fmt.Errorf("%s %d failed %d times, last when its output on %s could not be fetched", kind, n, *failures, host))
+	}
+}
+
+// re-executes the task whose output the final merge could not fetch, along
+// with the other outputs of the phase stored on the same worker
+func (t *Tasks) reopenUnreachable(i int) {
+	if len(t.RTasks) == 0 {
+		host := t.MTasks[i].FinishedBy
+		for m := range t.MTasks {
+			if t.MTasks[m].Finished && t.MTasks[m].FinishedBy == host {
+				t.reopenMap(m, "is unreachable")
+			}
+		}
+		return
+	}
+	host := t.RTasks[i].FinishedBy
+	for r := range t.RTasks {
+		if t.RTasks[r].Finished && t.RTasks[r].FinishedBy == host {
+			t.reopenReduce(r, "is unreachable")
+		}
+	}
+}
+
+// records how long the winning attempt took; the first attempt to commit
+// wins and any other attempt still running becomes stale
+func (t *Tasks) commit(lease Lease) time.Duration {
+	if lease.Backup {
+		t.BackupWins += 1
+	}
+	return time.Since(lease.Started)
+}
+
+// with nothing left to hand out in the current phase, gives worker a backup
+// attempt of the slowest task still running, if it has been running for
+// longer than StragglerFactor times the median runtime of the phase
+func (t *Tasks) leaseBackup(worker string, mapsFinished bool, task *Task) {
+	if t.StragglerFactor <= 0 {
+		return
+	}
+	now := time.Now()
+	var runtimes []time.Duration
+	slowest, slowestFor := -1, time.Duration(0)
+
+	// only tasks with a single attempt on some other worker qualify
+	consider := func(n int, leases []Lease) {
+		if len(leases) == 1 && leases[0].Worker != worker {
+			if running := now.Sub(leases[0].Started); running > slowestFor {
+				slowest, slowestFor = n, running
+			}
+		}
+	}
+	if !mapsFinished {
+		for i, mT := range t.MTasks {
+			if mT.Finished {
+				runtimes = append(runtimes, mT.Runtime)
+			} else {
+				consider(i, mT.Leases)
+			}
+		}
+	} else {
+		for i, rT := range t.RTasks {
+			if rT.Finished {
+				runtimes = append(runtimes, rT.Runtime)
+			} else {
+				consider(i, rT.Leases)
+			}
+		}
+	}
+	if slowest < 0 || len(runtimes) == 0 {
+		return
+	}
+
+	sort.Slice(runtimes, func(i, j int) bool { return runtimes[i] < runtimes[j] })
+	median := runtimes[len(runtimes)/2]
+	if float64(slowestFor) < t.StragglerFactor*float64(median) {
+		return
+	}
+
+	t.Backups += 1
+	if !mapsFinished {
+		fmt.Printf("Maptask %d running for %v (median %v), launching a backup on %s\n", slowest, slowestFor.Round(time.Millisecond), median.Round(time.Millisecond), worker)
+		t.leaseMap(slowest, worker, true, task)
+	} else {
+		fmt.Printf("Reducetask %d running for %v (median %v), launching a backup on %s\n", slowest, slowestFor.Round(time.Millisecond), median.Round(time.Millisecond), worker)
+		t.leaseReduce(slowest, worker, true, task)
+	}
+}
+
+// once every reduce task is finished, merges the reduce outputs into the
+// final output file and ends the job. A map-only job (R=0) is done once
+// every map task is, and merges the map outputs instead. An output that
+// can't be fetched is re-executed, and the job ends once it is back.
+func (t *Tasks) checkDone() {
+	var databaseUrls []string
+	if len(t.RTasks) == 0 {
+		for i, task := range t.MTasks {
+			if !task.Finished {
+				return
+			}
+			databaseUrls = append(databaseUrls, makeURL(task.FinishedBy, task.FinishedByDir, mapOutputFile(i, 0)))
+		}
+	} else {
+		for i, task := range t.RTasks {
+			if !task.Finished {
+				return
+			}
+			databaseUrls = append(databaseUrls, makeURL(task.FinishedBy, task.FinishedByDir, reduceOutputFile(i)))
+		}
+	}
+
+	counters := t.counters()
+	err := writeOutput(t, databaseUrls, "finalOutput.db", t.Output, func(db *sql.DB) error {
+		if err := writeMetadata(db, t.metadata()); err != nil {
+			return err
+		}
+		return writeCounters(db, counters)
+	})
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		log.Printf("error writing final output: %v", err)
+		if len(t.RTasks) == 0 {
+			t.countUnreachable(true, fetchErr.Index, t.MTasks[fetchErr.Index].FinishedBy)
+		} else {
+			t.countUnreachable(false, fetchErr.Index, t.RTasks[fetchErr.Index].FinishedBy)
+		}
+		if !t.Finished {
+			t.reopenUnreachable(fetchErr.Index)
+		}
+		return
+	}
+	counters.print()
+	if err == nil {
+		fmt.Printf("%s Created!\n", t.Output)
+		err = writeQuarantine(t)
+	}
+	if err != nil {
+		log.Printf("error writing final output: %v", err)
+	}
+	fmt.Printf("%d backup attempts launched, %d of them finished first\n", t.Backups, t.BackupWins)
+	t.finish(err)
+}
+
+// adds up the counters of the finished tasks; a task only keeps those of
+// the attempt that finished it, so retries and backups count once
+func (t *Tasks) counters() Counters {
+	total := make(Counters)
+	total.add(t.InputCounters)
+	for _, mT := range t.MTasks {
+		total.add(mT.Counters)
+	}
+	for _, rT := range t.RTasks {
+		total.add(rT.Counters)
+	}
+	return total
+}
+
+// describes how the job was run, saved alongside the final output
+func (t *Tasks) metadata() []Pair {
+	meta := []Pair{
+		{Key: "job", Value: t.Name},
+		{Key: "m", Value: strconv.Itoa(len(t.MTasks))},
+		{Key: "r", Value: strconv.Itoa(len(t.RTasks))},
+		{Key: "partitioner", Value: t.Partitioner},
+		{Key: "sorted", Value: strconv.FormatBool(t.Sorted)},
+	}
+	for i := range t.Inputs {
+		meta = append(meta, Pair{Key: "input " + t.Inputs[i].Name, Value: t.Inputs[i].String()})
+	}
+	var names []string
+	for name := range t.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		meta = append(meta, Pair{Key: "param " + name, Value: t.Params[name]})
+	}
+	return meta
+}
+
+// ends the job, successfully if err is nil; workers are told to shut down
+// and runMaster gets err
+func (t *Tasks) finish(err error) {
+	if t.Finished {
+		return
+	}
+	// t.Finished is for workers when they RPC ShutdownOk
+	t.Finished = true
+	// t.FinChannel is for the master to know that Merge is complete, it just has to wait for workers to shut down
+	*t.FinChannel <- err
+}
@@ -0,0 +1,187 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Codec turns values of type T into the strings that go through the
+// pipeline and back
+type Codec[T any] interface {
+	Encode(T) (string, error)
+	Decode(string) (T, error)
+}
+
+// StringCodec passes strings through unchanged
+type StringCodec struct{}
+
+func (StringCodec) Encode(s string) (string, error) { return s, nil }
+func (StringCodec) Decode(s string) (string, error) { return s, nil }
+
+// IntCodec writes ints in decimal. Keys are compared as text unless the job
+// sets an Order such as NumericOrder.
+type IntCodec struct{}
+
+func (IntCodec) Encode(n int) (string, error) { return strconv.Itoa(n), nil }
+func (IntCodec) Decode(s string) (int, error) { return strconv.Atoi(s) }
+
+// FloatCodec writes float64s in the shortest form that reads back exactly
+type FloatCodec struct{}
+
+func (FloatCodec) Encode(f float64) (string, error) { return strconv.FormatFloat(f, 'g', -1, 64), nil }
+func (FloatCodec) Decode(s string) (float64, error) { return strconv.ParseFloat(s, 64) }
+
+// JSONCodec stores values of any type JSON can handle, structs included
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (JSONCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// BytesCodec stores raw bytes as they are (sqlite keeps the bytes of text
+// as they are too, so nothing is lost on the way through)
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(b []byte) (string, error) { return string(b), nil }
+func (BytesCodec) Decode(s string) ([]byte, error) { return []byte(s), nil }
+
+// KV is a typed key/value pair
+type KV[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// Job is a typed map reduce job layered on the string pipeline: input pairs
+// are decoded to K1/V1 for Map, Map's K2/V2 output is encoded for the
+// shuffle and decoded again for Reduce, and Reduce's K3/V3 output is encoded
+// into the final output. A value that doesn't decode fails the task attempt
+// (and counts against its record when skipping is on) instead of turning
+// into a zero.
+type Job[K1, V1, K2, V2, K3, V3 any] struct {
+	Map    func(ctx *TaskContext, key K1, value V1, output chan<- KV[K2, V2]) error
+	Reduce func(ctx *TaskContext, key K2, values <-chan V2, output chan<- KV[K3, V3]) error
+
+	InKey    Codec[K1]
+	InValue  Codec[V1]
+	MidKey   Codec[K2]
+	MidValue Codec[V2]
+	OutKey   Codec[K3]
+	OutValue Codec[V3]
+
+	// how Reduce's keys are ordered, compared in their encoded form (text
+	// order if nil)
+	Order Comparator
+}
+
+// Start runs this process as a master or a worker for the job
+func (j Job[K1, V1, K2, V2, K3, V3]) Start() error {
+	if j.Map == nil || j.Reduce == nil {
+		return errors.New("job needs both Map and Reduce")
+	}
+	if j.InKey == nil || j.InValue == nil || j.MidKey == nil || j.MidValue == nil || j.OutKey == nil || j.OutValue == nil {
+		return errors.New("job needs a codec for every key and value")
+	}
+	return StartContext(j)
+}
+
+func (j Job[K1, V1, K2, V2, K3, V3]) KeyOrder() Comparator {
+	return j.Order
+}
+
+func (j Job[K1, V1, K2, V2, K3, V3]) MapContext(ctx *TaskContext, key, value string, output chan<- Pair) (err error) {
+	defer close(output)
+	k, err := j.InKey.Decode(key)
+	if err != nil {
+		return fmt.Errorf("decoding input key: %v", err)
+	}
+	v, err := j.InValue.Decode(value)
+	if err != nil {
+		return fmt.Errorf("decoding input value: %v", err)
+	}
+
+	typed := make(chan KV[K2, V2], 100)
+	encoded := make(chan error, 1)
+	go func() { encoded <- encodePairs(typed, output, j.MidKey, j.MidValue) }()
+
+	defer func() {
+		closeQuietly(typed)
+		if encodeErr := <-encoded; err == nil {
+			err = encodeErr
+		}
+	}()
+	return j.Map(ctx, k, v, typed)
+}
+
+func (j Job[K1, V1, K2, V2, K3, V3]) ReduceContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) (err error) {
+	defer close(output)
+	k, err := j.MidKey.Decode(key)
+	if err != nil {
+		return fmt.Errorf("decoding key: %v", err)
+	}
+
+	// a value that doesn't decode ends the values Reduce sees, and the error
+	// wins over whatever Reduce made of the shortened list
+	typedValues := make(chan V2)
+	decoded := make(chan error, 1)
+	go func() {
+		defer close(typedValues)
+		for value := range values {
+			v, err := j.MidValue.Decode(value)
+			if err != nil {
+				decoded <- fmt.Errorf("decoding value: %v", err)
+				return
+			}
+			typedValues <- v
+		}
+		decoded <- nil
+	}()
+
+	typed := make(chan KV[K3, V3], 100)
+	encoded := make(chan error, 1)
+	go func() { encoded <- encodePairs(typed, output, j.OutKey, j.OutValue) }()
+
+	defer func() {
+		closeQuietly(typed)
+		encodeErr := <-encoded
+		for range typedValues {
+		}
+		if decodeErr := <-decoded; decodeErr != nil {
+			err = decodeErr
+		} else if err == nil {
+			err = encodeErr
+		}
+	}()
+	return j.Reduce(ctx, k, typedValues, typed)
+}
+
+// encodes the pairs from typed into output until typed is closed, returning
+// the first error (the pair is dropped and the rest still drained)
+func encodePairs[K, V any](typed <-chan KV[K, V], output chan<- Pair, keys Codec[K], values Codec[V]) error {
+	var firstErr error
+	for pair := range typed {
+		if firstErr != nil {
+			continue
+		}
+		key, err := keys.Encode(pair.Key)
+		if err != nil {
+			firstErr = fmt.Errorf("encoding key: %v", err)
+			continue
+		}
+		value, err := values.Encode(pair.Value)
+		if err != nil {
+			firstErr = fmt.Errorf("encoding value: %v", err)
+			continue
+		}
+		output <- Pair{Key: key, Value: value}
+	}
+	return firstErr
+}
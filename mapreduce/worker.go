@@ -1,31 +1,54 @@
 package mapreduce
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"hash/fnv"
 	"log"
-	"strconv"
+	"runtime/debug"
+	"time"
 )
 
 type MapTask struct {
-	M, R        int    // number of map/reduce tasks
-	N           int    // n'th map task (assigned number)
-	SourceHost  string // address of host of input file
-	SourcePort  string // port of host of the input
-	Distributed bool
-	Finished    bool
+	M, R          int    // number of map/reduce tasks
+	N             int    // n'th map task (assigned number)
+	SourceHost    string // address of host of input file
+	SourceDir     string // temporary directory of the host of the input
+	Distributed   bool
+	Finished      bool
+	FinishedBy    string  // address of the worker holding the output
+	FinishedByDir string  // temporary directory of the worker holding the output
+	Attempts      int     // number of attempts handed out so far
+	Leases        []Lease // attempts currently running (master only)
+	Runtime       time.Duration
+	Failures      int            // attempts that reported an error, and outputs that could not be fetched
+	BadRecords    map[string]int // failures blamed on each input key (master only)
+	Skip          []string       // input keys to quarantine instead of mapping
+	Skipped       int            // records quarantined by the finished attempt
+	Counters      Counters       // counters of the finished attempt (master only)
+	Partitioner   string         // name of the partitioner the job uses
+	Sort          bool           // range partition on Splits instead (total-order sort)
+	Splits        []string       // R-1 split points sampled by the master
+	Input         string         // name of the input the task reads
 }
 
 type ReduceTask struct {
-	M, R           int      // number of map/reduce tasks
-	N              int      // n'th map task (assigned number)
-	SourceHosts    []string // address of the map workers sourcing input
-	SourcePorts    []string // port of the map workers sourcing input
-	Distributed    bool
-	Finished       bool
-	FinishedBy     string
-	FinishedByPort string
+	M, R          int      // number of map/reduce tasks
+	N             int      // n'th map task (assigned number)
+	SourceHosts   []string // address of the map workers sourcing input
+	SourceDirs    []string // temporary directories of the map workers sourcing input
+	Distributed   bool
+	Finished      bool
+	FinishedBy    string
+	FinishedByDir string
+	Attempts      int     // number of attempts handed out so far
+	Leases        []Lease // attempts currently running (master only)
+	Runtime       time.Duration
+	Failures      int            // attempts that reported an error, and outputs that could not be fetched
+	BadRecords    map[string]int // failures blamed on each key (master only)
+	Skip          []string       // keys to quarantine instead of reducing
+	Skipped       int            // records quarantined by the finished attempt
+	Counters      Counters       // counters of the finished attempt (master only)
 }
 
 type Pair struct {
@@ -33,20 +56,147 @@ type Pair struct {
 	Value string
 }
 
-type MapLog struct {
-	tasks int
-	pairs int
+type Interface interface {
+	Map(key, value string, output chan<- Pair) error
+	Reduce(key string, values <-chan string, output chan<- Pair) error
 }
 
-type ReduceLog struct {
-	keys   int
-	values int
-	pairs  int
+// UserError is a failure inside the client's Map or Reduce: either an error
+// it returned or a panic it raised, along with the key it was working on
+type UserError struct {
+	Func  string // "Map" or "Reduce"
+	Key   string
+	Err   error
+	Stack string // stack trace of the panic, empty for returned errors
 }
 
-type Interface interface {
-	Map(key, value string, output chan<- Pair) error
-	Reduce(key string, values <-chan string, output chan<- Pair) error
+// Unwrap lets errors.Is see a context.Canceled the client returned
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UserError) Error() string {
+	if e.Stack != "" {
+		return fmt.Sprintf("%s panicked on key %q: %v\n%s", e.Func, e.Key, e.Err, e.Stack)
+	}
+	return fmt.Sprintf("%s failed on key %q: %v", e.Func, e.Key, e.Err)
+}
+
+// ReduceError is what a reduce task attempt fails with once it has started
+// reducing: what it was doing, the key it was on (if any) and the cause,
+// which is a *UserError when the client's Reduce failed
+type ReduceError struct {
+	TaskN int
+	Op    string // [ex. "reducing", "writing output", "reading input"]
+	Key   string
+	Err   error
+}
+
+func (e *ReduceError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReduceError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("reduce task %d %s: %v", e.TaskN, e.Op, e.Err)
+	}
+	return fmt.Sprintf("reduce task %d %s (key %q): %v", e.TaskN, e.Op, e.Key, e.Err)
+}
+
+// runs client.Map, turning a panic into a *UserError and making sure
+// output gets closed either way
+func callMap(client ContextInterface, ctx *TaskContext, key, value string, output chan<- Pair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &UserError{Func: "Map", Key: key, Err: fmt.Errorf("%v", r), Stack: string(debug.Stack())}
+		}
+		if err != nil {
+			closeQuietly(output)
+		}
+	}()
+	if err := client.MapContext(ctx, key, value, output); err != nil {
+		return &UserError{Func: "Map", Key: key, Err: err}
+	}
+	return nil
+}
+
+// runs client.Reduce like callMap does client.Map; values left unread when
+// it returns are drained so whoever feeds them never blocks
+func callReduce(client ContextInterface, ctx *TaskContext, key string, values <-chan string, output chan<- Pair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &UserError{Func: "Reduce", Key: key, Err: fmt.Errorf("%v", r), Stack: string(debug.Stack())}
+		}
+		if err != nil {
+			closeQuietly(output)
+		}
+		for range values {
+		}
+	}()
+	if err := client.ReduceContext(ctx, key, values, output); err != nil {
+		return &UserError{Func: "Reduce", Key: key, Err: err}
+	}
+	return nil
+}
+
+// closes a channel the client may or may not have closed already. The
+// adapters that copy a client's output into their own (Job, byteClient) use
+// it to end the copy and wait for it before closing their output, so the
+// copy finishes even if Map or Reduce panics or forgets to close its output.
+func closeQuietly[T any](output chan<- T) {
+	defer func() { recover() }()
+	close(output)
+}
+
+// quarantine holds the records a task was told to skip; a nil quarantine
+// skips nothing
+type quarantine struct {
+	skip  map[string]bool
+	db    *sql.DB
+	stmt  *sql.Stmt
+	blobs bool // see storesBlobs
+	n     int
+}
+
+// creates the quarantine database at path, unless there is nothing to skip
+func openQuarantine(path string, keys []string, blobs bool) (*quarantine, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	db, err := createDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := db.Prepare("insert into pairs (key, value) values (?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	q := &quarantine{skip: make(map[string]bool), db: db, stmt: stmt, blobs: blobs}
+	for _, key := range keys {
+		q.skip[key] = true
+	}
+	return q, nil
+}
+
+func (q *quarantine) has(key string) bool {
+	return q != nil && q.skip[key]
+}
+
+func (q *quarantine) add(key, value string) error {
+	q.n += 1
+	_, err := q.stmt.Exec(pairArgs(Pair{Key: key, Value: value}, q.blobs))
+	return err
+}
+
+// closes the database and returns how many records went into it
+func (q *quarantine) close() int {
+	if q == nil {
+		return 0
+	}
+	q.stmt.Close()
+	q.db.Close()
+	return q.n
 }
 
 func mapSourceFile(m int) string     { return fmt.Sprintf("map_%d_source.db", m) }
@@ -56,27 +206,46 @@ func reduceInputFile(r int) string   { return fmt.Sprintf("reduce_%d_input.db",
 func reduceOutputFile(r int) string  { return fmt.Sprintf("reduce_%d_output.db", r) }
 func reducePartialFile(r int) string { return fmt.Sprintf("reduce_%d_partial.db", r) }
 func reduceTempFile(r int) string    { return fmt.Sprintf("reduce_%d_temp.db", r) }
+func mapSkippedFile(m int) string    { return fmt.Sprintf("map_%d_skipped.db", m) }
+func reduceSkippedFile(r int) string { return fmt.Sprintf("reduce_%d_skipped.db", r) }
 func makeTempDir(port string) string { return fmt.Sprintf("tmp%s/", port) }
-func makeURL(host, port, file string) string {
-	return fmt.Sprintf("http://%s/data/%s%s", host, makeTempDir(port), file)
+func makeURL(host, dir, file string) string {
+	return fmt.Sprintf("http://%s/data/%s%s", host, dir, file)
 }
 
-func (task *MapTask) Process(tempdir string, client Interface) error {
+func (task *MapTask) Process(tempdir string, client ContextInterface, ctx *TaskContext) error {
+
+	// every map task has to split keys the same way the master expects
+	partitioner := clientPartitioner(client)
+	if task.Sort {
+		partitioner = RangePartitioner{Splits: task.Splits, Compare: clientKeyOrder(client)}
+	}
+	if name := partitionerName(partitioner); name != task.Partitioner {
+		return fmt.Errorf("worker partitions with %s but the job uses %s", name, task.Partitioner)
+	}
 
 	// download the input file
-	if err := download(makeURL(task.SourceHost, task.SourcePort, mapSourceFile(task.N)), tempdir+mapInputFile(task.N)); err != nil {
+	if err := download(makeURL(task.SourceHost, task.SourceDir, mapSourceFile(task.N)), tempdir+mapInputFile(task.N)); err != nil {
 		log.Printf("error downloading in MapTask.Process: %v", err)
+		return err
 	}
 
 	// open the input file
 	inputDB, err := openDatabase("data/" + tempdir + mapInputFile(task.N))
 	if err != nil {
 		log.Printf("error opening input file in MapTask.Process: %v", err)
+		return err
 	}
+	defer inputDB.Close()
 
 	// create the output files
 	var outputDBs []*sql.DB
-	for i := 0; i < task.R; i++ {
+	defer func() {
+		for _, db := range outputDBs {
+			db.Close()
+		}
+	}()
+	for i := 0; i < task.partitions(); i++ {
 		newDB, err := createDatabase("data/" + tempdir + mapOutputFile(task.N, i))
 		if err != nil {
 			log.Printf("error creating output files in MapTask.Process: %v", err)
@@ -85,17 +254,37 @@ func (task *MapTask) Process(tempdir string, client Interface) error {
 		outputDBs = append(outputDBs, newDB)
 	}
 
+	// records the master told us to skip go to the quarantine instead
+	blobs := storesBlobs(client)
+	skipped, err := openQuarantine("data/"+tempdir+mapSkippedFile(task.N), task.Skip, blobs)
+	if err != nil {
+		log.Printf("error creating quarantine in MapTask.Process: %v", err)
+		return err
+	}
+	defer func() {
+		task.Skipped = skipped.close()
+		IncrCounter(SkippedRecords, int64(task.Skipped))
+	}()
+
 	// prepare statements
 	var outputStmts []*sql.Stmt
 	for _, db := range outputDBs {
 		stmt, err := db.Prepare("insert into pairs (key, value) values (?, ?)")
 		if err != nil {
-			log.Fatalf("error in MapProcess statement generation: %v", err)
+			log.Printf("error in MapTask.Process statement generation: %v", err)
+			return err
 		}
 		outputStmts = append(outputStmts, stmt)
 		defer stmt.Close()
 	}
 
+	// a client that can combine gets its output grouped in memory first,
+	// unless the job is map-only and the map output is the final output
+	var combine *combineBuffer
+	if combiner, ok := clientImpl(client).(Combiner); ok && task.R > 0 {
+		combine = newCombineBuffer(combiner, task.partitions(), blobs)
+	}
+
 	// run a query to select ALL PAIRS from SOURCE DB
 	rows, err := inputDB.Query(`SELECT key, value FROM pairs`)
 	if err != nil {
@@ -103,68 +292,112 @@ func (task *MapTask) Process(tempdir string, client Interface) error {
 		return err
 	}
 	var key, value string
-	var mlog MapLog = MapLog{tasks: 0, pairs: 0}
 	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := rows.Scan(&key, &value); err != nil {
 			log.Printf("error in splitDatabase during scan: %v", err)
 			return err
 		}
+		IncrCounter(MapInputRecords, 1)
+		if skipped.has(key) {
+			if err := skipped.add(key, value); err != nil {
+				return err
+			}
+			continue
+		}
 
 		// call client.Map with the pair AND launch go routine to collect output pair
 		outputPair := make(chan Pair, 100)
-		finished := make(chan struct{})
+		finished := make(chan error)
+
+		go mapCollectPair(outputPair, finished, outputStmts, blobs, task.R, partitioner, combine)
 
-		go mapCollectPair(outputPair, finished, outputStmts, task.R, &mlog)
+		err := callMap(client, ctx, key, value, outputPair)
 
-		if err := client.Map(key, value, outputPair); err != nil {
+		// accept a value from finished chan signaling 'sync'
+		collectErr := <-finished
+		if err != nil {
 			log.Printf("error in MapTask.Process during client.Map: %v", err)
 			return err
 		}
+		if collectErr != nil {
+			log.Printf("error in MapTask.Process writing map output: %v", collectErr)
+			return collectErr
+		}
 
-		// accept a value from finished chan signaling 'sync'
-		<-finished
+		// don't let the combine buffer grow without bound
+		if combine != nil && combine.full() {
+			if err := combine.spill(outputStmts); err != nil {
+				log.Printf("error in MapTask.Process during client.Combine: %v", err)
+				return err
+			}
+		}
 	}
 
-	// close databases before finishing the function
-	inputDB.Close()
-	for _, db := range outputDBs {
-		db.Close()
+	if combine != nil {
+		if err := combine.spill(outputStmts); err != nil {
+			log.Printf("error in MapTask.Process during client.Combine: %v", err)
+			return err
+		}
 	}
-
-	fmt.Printf("map task processed %d pairs, generated %d pairs\n", mlog.tasks, mlog.pairs)
 	return nil
 }
 
-func mapCollectPair(outputPair <-chan Pair, finished chan<- struct{}, outputStmts []*sql.Stmt, reduceTasks int, mlog *MapLog) {
-	mlog.tasks += 1
+// number of output files the map task writes: one per reduce task, or a
+// single one that goes straight to the final output in a map-only job
+func (task *MapTask) partitions() int {
+	if task.R == 0 {
+		return 1
+	}
+	return task.R
+}
+
+// partitions the pairs Map emits, writing them out directly or holding them
+// in combine when the client is a Combiner. The first error is sent on
+// finished once Map is done; the rest of the output is drained and dropped.
+// Without reduce tasks everything goes to the one output.
+func mapCollectPair(outputPair <-chan Pair, finished chan<- error, outputStmts []*sql.Stmt, blobs bool, reduceTasks int, partitioner Partitioner, combine *combineBuffer) {
+	var err error
+	var pairs int64
+	defer func() { IncrCounter(MapOutputRecords, pairs) }()
 	for pair := range outputPair {
-		hash := fnv.New32()
-		hash.Write([]byte(pair.Key))
-		r := int(hash.Sum32() % uint32(reduceTasks))
-		stmt := outputStmts[r]
-		_, err := stmt.Exec(pair.Key, pair.Value)
 		if err != nil {
-			log.Fatalf("error in mapCollectPair during insert: %v", err)
-			finished <- struct{}{}
+			continue
+		}
+		var r int
+		if reduceTasks > 0 {
+			if r, err = partition(partitioner, pair.Key, reduceTasks); err != nil {
+				continue
+			}
+		}
+		pairs += 1
+		if combine != nil {
+			combine.add(r, pair)
+			continue
+		}
+		if _, err = outputStmts[r].Exec(pairArgs(pair, blobs)); err != nil {
+			err = fmt.Errorf("error in mapCollectPair during insert: %v", err)
 		}
-		mlog.pairs += 1
 	}
-	finished <- struct{}{}
+	finished <- err
 }
 
-func (task *ReduceTask) Process(tempdir string, client Interface) error {
+func (task *ReduceTask) Process(tempdir string, client ContextInterface, ctx *TaskContext) error {
 	// create inputDB by merging map outputs
-	
+
 	var outputURLs []string
 	for i, host := range task.SourceHosts {
-		outputURLs = append(outputURLs, makeURL(host, task.SourcePorts[i], (mapOutputFile(i, task.N))))
+		outputURLs = append(outputURLs, makeURL(host, task.SourceDirs[i], (mapOutputFile(i, task.N))))
 	}
 
-	inputDB, err := mergeDatabases(outputURLs, tempdir+reduceOutputFile(task.N), tempdir+reduceTempFile(task.N))
+	inputDB, err := mergeDatabases(outputURLs, tempdir+reduceInputFile(task.N), tempdir+reduceTempFile(task.N))
 	if err != nil {
 		log.Printf("error in ReduceTask.Process mergeDatabases: %v", err)
 		return err
 	}
+	defer inputDB.Close()
 
 	// create outputDB
 	outputDB, err := createDatabase("data/" + tempdir + reduceOutputFile(task.N))
@@ -172,84 +405,191 @@ func (task *ReduceTask) Process(tempdir string, client Interface) error {
 		log.Printf("error in ReduceTask.Process creating outputDB: %v", err)
 		return err
 	}
+	defer outputDB.Close()
+
+	// keys the master told us to skip go to the quarantine instead
+	skipped, err := openQuarantine("data/"+tempdir+reduceSkippedFile(task.N), task.Skip, storesBlobs(client))
+	if err != nil {
+		log.Printf("error creating quarantine in ReduceTask.Process: %v", err)
+		return err
+	}
+	defer func() {
+		task.Skipped = skipped.close()
+		IncrCounter(SkippedRecords, int64(task.Skipped))
+	}()
 
-	// query pairs in correct order
-	rows, err := inputDB.Query(`SELECT key, value FROM pairs ORDER BY key, value`)
+	// query pairs in the client's key order
+	rows, err := queryOrdered(inputDB, clientKeyOrder(client))
 	if err != nil {
 		log.Printf("error in ReduceTask.Process during query: %v", err)
 		return err
 	}
+	defer rows.Close()
+
+	exec, err := newReduceExecutor(client, ctx, task.N, outputDB)
+	if err != nil {
+		log.Printf("error in ReduceTask.Process preparing output: %v", err)
+		return err
+	}
+	defer exec.close()
 
-	// iteration over query'd values
-	var key, value, prevKey string
+	// iteration over query'd values; Reduce gets one call per group key,
+	// which is the key itself unless the client is a Grouper
+	var key, value, prevGroup string
 	var newKey bool = true
-	var outputChan (chan Pair)
-	var valChan (chan string)
-	var finished (chan struct{})
-	prevKey = ""
-	rlog := ReduceLog{keys: 0, values: 0, pairs: 0}
+	var skipping bool
 	for rows.Next() {
+		if err := exec.ctx.Err(); err != nil {
+			return exec.fail("reading input", "", err)
+		}
 		if err := rows.Scan(&key, &value); err != nil {
-			log.Printf("error in ReduceTask.Process during scan: %v", err)
-			close(finished)
-			close(valChan)
-			close(outputChan)
-			return err
+			return exec.fail("reading input", "", err)
+		}
+		group, err := groupKey(client, key)
+		if err != nil {
+			return exec.fail("grouping", key, err)
 		}
 
 		// is it a new key? (not including the first)
-		if prevKey != "" && prevKey != key {
+		if !newKey && prevGroup != group {
 			newKey = true
-			close(valChan)
-			<-finished
+			if err := exec.end(); err != nil {
+				return err
+			}
 		}
 
 		// new key case
+		IncrCounter(ReduceInputRecords, 1)
 		if newKey {
-			valChan = make(chan string)
-			outputChan = make(chan Pair, 100)
-			finished = make(chan struct{})
-
-			go reduceCollectPair(outputChan, finished, outputDB, &rlog)
-			go client.Reduce(key, valChan, outputChan)
+			skipping = skipped.has(group)
+			if !skipping {
+				exec.start(group)
+			}
 		}
 
-		valChan <- value
-		prevKey = key
+		if skipping {
+			if err := skipped.add(key, value); err != nil {
+				return exec.fail("quarantining", key, err)
+			}
+		} else {
+			exec.values <- value
+		}
+		prevGroup = group
 		newKey = false
 	}
+	if err := rows.Err(); err != nil {
+		return exec.fail("reading input", "", err)
+	}
+	return exec.end()
+}
 
-	// close all DBs before returning
-	close(valChan)
-	<-finished
-
-	fmt.Printf("reduce task processed %d keys and %d values, generated %d pairs\n", rlog.keys, rlog.values, rlog.pairs)
-	return nil
+// reduceExecutor runs Reduce on one group at a time and writes its output
+// as it comes. The first error, from Reduce or from writing its output,
+// cancels the rest of the task and is the one the task fails with.
+type reduceExecutor struct {
+	client ContextInterface
+	ctx    *TaskContext // the task's context, cancelled on the first error
+	cancel context.CancelFunc
+	taskN  int
+	stmt   *sql.Stmt
+	blobs  bool // see storesBlobs
+
+	// the group being reduced; values is nil between groups
+	key     string
+	values  chan string
+	reduced chan error
+	written chan error
 }
 
-func reduceCollectPair(outputPair <-chan Pair, finished chan<- struct{}, outputDB *sql.DB, rlog *ReduceLog) {
-	defer close(finished)
+func newReduceExecutor(client ContextInterface, ctx *TaskContext, taskN int, outputDB *sql.DB) (*reduceExecutor, error) {
 	stmt, err := outputDB.Prepare("insert into pairs (key, value) values (?, ?)")
 	if err != nil {
-		log.Fatalf("error in reduceCollectPair")
+		return nil, err
 	}
-	defer stmt.Close()
+	taskCtx := *ctx
+	var cancel context.CancelFunc
+	taskCtx.Context, cancel = context.WithCancel(ctx)
+	return &reduceExecutor{client: client, ctx: &taskCtx, cancel: cancel, taskN: taskN, stmt: stmt, blobs: storesBlobs(client)}, nil
+}
 
-	rlog.keys += 1
-	for pair := range outputPair {
-		_, err := stmt.Exec(pair.Key, pair.Value)
+// starts Reduce on the values of a new group
+func (e *reduceExecutor) start(key string) {
+	e.key = key
+	e.values = make(chan string)
+	e.reduced = make(chan error, 1)
+	e.written = make(chan error, 1)
+	output := make(chan Pair, 100)
+
+	IncrCounter(ReduceInputGroups, 1)
+	go func(values <-chan string) {
+		e.reduced <- callReduce(e.client, e.ctx, key, values, output)
+	}(e.values)
+	go func() {
+		e.written <- e.write(output)
+	}()
+}
+
+// writes the output of one Reduce call; after a failed insert the rest is
+// drained and dropped, and the task cancelled so Reduce can stop early
+func (e *reduceExecutor) write(output <-chan Pair) error {
+	var err error
+	var pairs int64
+	defer func() { IncrCounter(ReduceOutputRecords, pairs) }()
+	for pair := range output {
 		if err != nil {
-			log.Fatalf("error in reduceCollectPair during insert: %v", err)
-			finished <- struct{}{}
+			continue
 		}
-		rlog.pairs += 1
-		if i, err := strconv.Atoi(pair.Value); err != nil {
-			log.Printf("error in reduceCollectPair: %v", err)
-		} else {
-			rlog.values += i
+		if _, err = e.stmt.Exec(pairArgs(pair, e.blobs)); err != nil {
+			e.cancel()
+			continue
 		}
+		pairs += 1
 	}
-	finished <- struct{}{}
+	return err
+}
+
+// ends the group being reduced, if there is one, and waits for its Reduce
+// and its output. A failed write is reported over the error Reduce returns,
+// which is likely just the cancellation the write caused.
+func (e *reduceExecutor) end() error {
+	if e.values == nil {
+		return nil
+	}
+	close(e.values)
+	e.values = nil
+	reduceErr, writeErr := <-e.reduced, <-e.written
+
+	var err error
+	switch {
+	case writeErr != nil:
+		err = &ReduceError{TaskN: e.taskN, Op: "writing output", Key: e.key, Err: writeErr}
+	case reduceErr != nil:
+		err = &ReduceError{TaskN: e.taskN, Op: "reducing", Key: e.key, Err: reduceErr}
+	default:
+		return nil
+	}
+	e.cancel()
+	log.Printf("error in ReduceTask.Process: %v", err)
+	return err
+}
+
+// fails the task with err, unless the group being reduced failed first
+// (that is the cause, and err likely the cancellation it led to)
+func (e *reduceExecutor) fail(op, key string, err error) error {
+	if groupErr := e.end(); groupErr != nil {
+		return groupErr
+	}
+	e.cancel()
+	reduceErr := &ReduceError{TaskN: e.taskN, Op: op, Key: key, Err: err}
+	log.Printf("error in ReduceTask.Process: %v", reduceErr)
+	return reduceErr
+}
+
+// waits for any Reduce still running and releases the output statement
+func (e *reduceExecutor) close() {
+	e.end()
+	e.cancel()
+	e.stmt.Close()
 }
 
 // UP TO query HAS BEEN COMPLETED/TESTED MINIMALLY